@@ -0,0 +1,166 @@
+package cfutil
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	cfenv "github.com/cloudfoundry-community/go-cfenv"
+	"github.com/mitchellh/mapstructure"
+)
+
+// MissingCredentialsError is returned when a bound service lacks
+// credentials that are tagged as `required`
+type MissingCredentialsError struct {
+	Service string
+	Keys    []string
+}
+
+func (e *MissingCredentialsError) Error() string {
+	return fmt.Sprintf("Service '%s' is missing credentials: %s", e.Service, strings.Join(e.Keys, ", "))
+}
+
+// BindService() looks up the service matching `selector` in the
+// DefaultEnvironment() and decodes its credentials into a new T.
+// See BindEnvironmentService() for details.
+func BindService[T any](selector string) (*T, error) {
+	env, err := DefaultEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	return BindEnvironmentService[T](env, selector)
+}
+
+// BindEnvironmentService() looks up the service matching `selector` by
+// name, tag or label (in that order) and decodes its credentials into a new T.
+// Fields of T are matched using `mapstructure` tags, e.g.
+//
+//	type VaultCredentials struct {
+//		Endpoint string `mapstructure:"endpoint,required"`
+//		RoleID   string `mapstructure:"role_id,required"`
+//	}
+//
+// Nested objects decode into nested structs and string values are coerced
+// into numbers, booleans and durations where needed. Credentials of fields
+// tagged `required` must be present, a *MissingCredentialsError listing
+// the missing keys is returned otherwise.
+func BindEnvironmentService[T any](env *Environment, selector string) (*T, error) {
+	service, err := env.serviceBySelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	var result T
+	if err := DecodeCredentials(service, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// DecodeCredentials() decodes the credentials of `service` into the struct
+// pointed to by `out`. It applies the same rules as BindEnvironmentService()
+func DecodeCredentials(service *cfenv.Service, out interface{}) error {
+	outType := reflect.TypeOf(out)
+	if outType == nil || outType.Kind() != reflect.Ptr || outType.Elem().Kind() != reflect.Struct {
+		return errors.New("Credentials can only be decoded into a pointer to a struct")
+	}
+	if missing := missingCredentials("", outType.Elem(), service.Credentials); len(missing) > 0 {
+		return &MissingCredentialsError{Service: service.Name, Keys: missing}
+	}
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+		WeaklyTypedInput: true,
+		Result:           out,
+	})
+	if err != nil {
+		return err
+	}
+	if err := decoder.Decode(service.Credentials); err != nil {
+		return fmt.Errorf("Error decoding credentials of service '%s': %s", service.Name, err.Error())
+	}
+	return nil
+}
+
+// missingCredentials returns the keys of all fields tagged `required`
+// that have no value in `credentials`, nested keys are joined with a dot
+func missingCredentials(prefix string, structType reflect.Type, credentials map[string]interface{}) []string {
+	var missing []string
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tagParts := strings.Split(field.Tag.Get("mapstructure"), ",")
+		name := tagParts[0]
+		required, squash := false, false
+		for _, option := range tagParts[1:] {
+			switch option {
+			case "required":
+				required = true
+			case "squash":
+				squash = true
+			}
+		}
+		fieldType := field.Type
+		for fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if squash && fieldType.Kind() == reflect.Struct {
+			missing = append(missing, missingCredentials(prefix, fieldType, credentials)...)
+			continue
+		}
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		value := credentialValue(credentials, name)
+		if value == nil {
+			if required {
+				missing = append(missing, prefix+name)
+			}
+			continue
+		}
+		if nested, ok := value.(map[string]interface{}); ok && fieldType.Kind() == reflect.Struct {
+			missing = append(missing, missingCredentials(prefix+name+".", fieldType, nested)...)
+		}
+	}
+	return missing
+}
+
+// credentialValue looks up `key` the way mapstructure does: an exact
+// match first, then a case insensitive one
+func credentialValue(credentials map[string]interface{}, key string) interface{} {
+	if value, ok := credentials[key]; ok {
+		return value
+	}
+	for k, value := range credentials {
+		if strings.EqualFold(k, key) {
+			return value
+		}
+	}
+	return nil
+}
+
+func (e *Environment) serviceBySelector(selector string) (*cfenv.Service, error) {
+	if selector == "" {
+		return nil, errors.New("No service name, tag or label given")
+	}
+	if service, err := e.serviceByName(selector); err == nil {
+		return service, nil
+	}
+	for _, query := range []Query{{Tag: selector}, {Label: selector}} {
+		services, err := e.FindServices(query)
+		if err != nil {
+			return nil, err
+		}
+		if len(services) > 0 {
+			return e.MustFindOne(query)
+		}
+	}
+	return nil, fmt.Errorf("No service found with name, tag or label '%s'", selector)
+}
@@ -0,0 +1,78 @@
+package cfutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testBrokerCredentials struct {
+	URI      string        `mapstructure:"uri,required"`
+	MaxConns int           `mapstructure:"max_conns"`
+	TLS      bool          `mapstructure:"tls"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+	Admin    struct {
+		URI      string `mapstructure:"uri,required"`
+		Username string `mapstructure:"username,required"`
+	} `mapstructure:"admin"`
+}
+
+func testBindEnvironment(t *testing.T) *Environment {
+	env, err := NewEnvironmentFromMap(map[string]string{
+		"VCAP_APPLICATION": `{"name":"myapp"}`,
+		"VCAP_SERVICES": `{
+			"broker": [{
+				"name": "broker-1",
+				"tags": ["messaging"],
+				"credentials": {
+					"uri": "amqp://localhost",
+					"max_conns": "20",
+					"tls": "true",
+					"timeout": "5s",
+					"admin": {"uri": "http://localhost:15672", "username": "admin"}
+				}
+			}],
+			"incomplete": [{
+				"name": "broker-2",
+				"tags": ["messaging"],
+				"credentials": {"admin": {"uri": "http://localhost:15672"}}
+			}]
+		}`,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return env
+}
+
+func TestBindEnvironmentService(t *testing.T) {
+	env := testBindEnvironment(t)
+
+	for _, selector := range []string{"broker-1", "broker"} {
+		creds, err := BindEnvironmentService[testBrokerCredentials](env, selector)
+		if !assert.NoError(t, err, selector) {
+			continue
+		}
+		assert.Equal(t, "amqp://localhost", creds.URI)
+		assert.Equal(t, 20, creds.MaxConns)
+		assert.Equal(t, true, creds.TLS)
+		assert.Equal(t, 5*time.Second, creds.Timeout)
+		assert.Equal(t, "admin", creds.Admin.Username)
+	}
+}
+
+func TestBindEnvironmentServiceErrors(t *testing.T) {
+	env := testBindEnvironment(t)
+
+	_, err := BindEnvironmentService[testBrokerCredentials](env, "broker-2")
+	if assert.IsType(t, &MissingCredentialsError{}, err) {
+		assert.Equal(t, []string{"uri", "admin.username"}, err.(*MissingCredentialsError).Keys)
+	}
+
+	_, err = BindEnvironmentService[testBrokerCredentials](env, "messaging")
+	assert.Error(t, err)
+
+	_, err = BindEnvironmentService[testBrokerCredentials](env, "unknown")
+	assert.Error(t, err)
+}
@@ -0,0 +1,498 @@
+package cfutiltest_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/loafoe/cfutil"
+	"github.com/loafoe/cfutil/cfutiltest"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+var fastBackoff = cfutil.Backoff{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+
+func waitFor(t *testing.T, condition func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("Timeout waiting for condition")
+	return false
+}
+
+func TestBrokerRouting(t *testing.T) {
+	broker := cfutiltest.NewBroker()
+	conn, _ := broker.Dial(broker.URI(), nil)
+	ch, err := conn.Channel()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, ch.ExchangeDeclare("events", amqp.ExchangeTopic, true, false, false, false, nil))
+	assert.NoError(t, ch.ExchangeDeclare("broadcast", amqp.ExchangeFanout, true, false, false, false, nil))
+	for _, name := range []string{"orders", "all", "fanout"} {
+		_, err := ch.QueueDeclare(name, true, false, false, false, nil)
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, ch.QueueBind("orders", "order.*", "events", false, nil))
+	assert.NoError(t, ch.QueueBind("all", "#", "events", false, nil))
+	assert.NoError(t, ch.QueueBind("fanout", "ignored", "broadcast", false, nil))
+
+	assert.NoError(t, ch.Publish("events", "order.created", false, false, amqp.Publishing{Body: []byte("1")}))
+	assert.NoError(t, ch.Publish("events", "order.line.added", false, false, amqp.Publishing{Body: []byte("2")}))
+	assert.NoError(t, ch.Publish("broadcast", "anything", false, false, amqp.Publishing{Body: []byte("3")}))
+	assert.NoError(t, ch.Publish("", "orders", false, false, amqp.Publishing{Body: []byte("4")}))
+
+	assert.Len(t, broker.Messages("orders"), 2)
+	assert.Len(t, broker.Messages("all"), 2)
+	assert.Len(t, broker.Messages("fanout"), 1)
+
+	err = ch.Publish("missing", "key", false, false, amqp.Publishing{})
+	assert.Error(t, err)
+	assert.Equal(t, amqp.ErrClosed, ch.Publish("events", "key", false, false, amqp.Publishing{}))
+}
+
+func TestBrokerHardErrorsCloseConnection(t *testing.T) {
+	broker := cfutiltest.NewBroker()
+	conn, _ := broker.Dial(broker.URI(), nil)
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	ch, _ := conn.Channel()
+	other, _ := conn.Channel()
+
+	// Soft errors only close the channel
+	assert.Error(t, ch.QueueBind("missing", "", "amq.topic", false, nil))
+	assert.NoError(t, other.Qos(1, 0, false))
+	ch, _ = conn.Channel()
+
+	err := ch.ExchangeDeclare("delayed", "x-delayed-message", true, false, false, false, amqp.Table{"x-delayed-type": "topic"})
+	if assert.Error(t, err) {
+		assert.Equal(t, amqp.CommandInvalid, err.(*amqp.Error).Code)
+	}
+	closed := <-connClosed
+	if assert.NotNil(t, closed) {
+		assert.Equal(t, amqp.CommandInvalid, closed.Code)
+	}
+	assert.Equal(t, amqp.ErrClosed, other.Qos(1, 0, false))
+	_, err = conn.Channel()
+	assert.Equal(t, amqp.ErrClosed, err)
+}
+
+func TestBrokerNackAndDeadLetter(t *testing.T) {
+	broker := cfutiltest.NewBroker()
+	conn, _ := broker.Dial(broker.URI(), nil)
+	ch, _ := conn.Channel()
+	ch.ExchangeDeclare("dlx", amqp.ExchangeFanout, true, false, false, false, nil)
+	ch.QueueDeclare("dead", true, false, false, false, nil)
+	ch.QueueBind("dead", "", "dlx", false, nil)
+	ch.QueueDeclare("work", true, false, false, false, amqp.Table{"x-dead-letter-exchange": "dlx"})
+	ch.Qos(1, 0, false)
+
+	deliveries, err := ch.Consume("work", "", false, false, false, false, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	broker.Publish("", "work", amqp.Publishing{Body: []byte("job")})
+
+	d := <-deliveries
+	assert.False(t, d.Redelivered)
+	assert.NoError(t, d.Nack(false, true))
+	d = <-deliveries
+	assert.True(t, d.Redelivered)
+	assert.NoError(t, d.Reject(false))
+
+	dead := broker.Messages("dead")
+	if assert.Len(t, dead, 1) {
+		deaths := dead[0].Headers["x-death"].([]interface{})
+		assert.Equal(t, "rejected", deaths[0].(amqp.Table)["reason"])
+	}
+
+	// Expired messages are dead-lettered too
+	ch.QueueDeclare("delay", true, false, false, false, amqp.Table{"x-message-ttl": int64(10), "x-dead-letter-exchange": "dlx"})
+	broker.Publish("", "delay", amqp.Publishing{Body: []byte("later")})
+	waitFor(t, func() bool { return len(broker.Messages("dead")) == 2 })
+}
+
+func TestConsumerRetry(t *testing.T) {
+	for _, queueName := range []string{"jobs", ""} {
+		for _, delay := range []time.Duration{0, 20 * time.Millisecond} {
+			broker := cfutiltest.NewBroker()
+			env, err := broker.Environment()
+			if !assert.NoError(t, err) {
+				return
+			}
+			var calls int32
+			consumer, err := env.NewConsumer(cfutil.ConsumerConfig{
+				Exchange:     "jobs",
+				ExchangeType: amqp.ExchangeTopic,
+				QueueName:    queueName,
+				RoutingKey:   "job.#",
+				Dialer:       broker.Dial,
+				Backoff:      fastBackoff,
+				RetryPolicy:  cfutil.RetryPolicy{MaxAttempts: 3, Delay: delay},
+				MessageHandler: func(ctx context.Context, d amqp.Delivery) error {
+					if atomic.AddInt32(&calls, 1) < 3 {
+						return errors.New("not yet")
+					}
+					return nil
+				},
+			})
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.NoError(t, consumer.Start())
+
+			producer, err := env.NewProducer(cfutil.ProducerConfig{Exchange: "jobs", ExchangeType: amqp.ExchangeTopic, Dialer: broker.Dial})
+			if !assert.NoError(t, err) {
+				return
+			}
+			start := time.Now()
+			assert.NoError(t, producer.PublishConfirmed(context.Background(), "jobs", "job.run", amqp.Publishing{Body: []byte("1")}))
+			waitFor(t, func() bool { return atomic.LoadInt32(&calls) == 3 })
+			assert.True(t, time.Since(start) >= 2*delay, "queue %q delay %s", queueName, delay)
+			_, hasRetryQueue := broker.Queue("jobs.retry")
+			assert.Equal(t, queueName != "" && delay > 0, hasRetryQueue)
+			producer.Close()
+			assert.NoError(t, consumer.Stop())
+			// Retry topology of a server-named queue goes away with the connection
+			var retries []string
+			for _, name := range append(broker.Queues(), broker.Exchanges()...) {
+				if strings.HasSuffix(name, ".retry") {
+					retries = append(retries, name)
+				}
+			}
+			if queueName != "" && delay > 0 {
+				assert.Equal(t, []string{"jobs.retry", "jobs.retry"}, retries)
+			} else {
+				assert.Empty(t, retries, "queue %q delay %s", queueName, delay)
+			}
+		}
+	}
+}
+
+func TestConsumerReconnectWaitsForHandlers(t *testing.T) {
+	broker := cfutiltest.NewBroker()
+	env, err := broker.Environment()
+	if !assert.NoError(t, err) {
+		return
+	}
+	var calls int32
+	started, release := make(chan struct{}), make(chan struct{})
+	consumer, err := env.NewConsumer(cfutil.ConsumerConfig{
+		QueueName:   "jobs",
+		Dialer:      broker.Dial,
+		Backoff:     fastBackoff,
+		RetryPolicy: cfutil.RetryPolicy{MaxAttempts: 3},
+		MessageHandler: func(ctx context.Context, d amqp.Delivery) error {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				close(started)
+				<-release
+				return errors.New("connection lost meanwhile")
+			}
+			return nil
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, consumer.Start())
+	defer consumer.Stop()
+
+	conn, _ := broker.Dial(broker.URI(), nil)
+	ch, _ := conn.Channel()
+	assert.NoError(t, ch.Publish("", "jobs", false, false, amqp.Publishing{Body: []byte("1")}))
+	<-started
+
+	// The retry of the running handler must not use the channel of the new connection
+	broker.Disconnect()
+	time.Sleep(50 * time.Millisecond)
+	q, _ := broker.Queue("jobs")
+	assert.Equal(t, 0, q.Consumers)
+	close(release)
+	waitFor(t, func() bool { return atomic.LoadInt32(&calls) == 2 })
+	q, _ = broker.Queue("jobs")
+	assert.Equal(t, 1, q.Consumers)
+}
+
+func TestConsumerReconnectsAfterChannelException(t *testing.T) {
+	broker := cfutiltest.NewBroker()
+	env, err := broker.Environment()
+	if !assert.NoError(t, err) {
+		return
+	}
+	var calls int32
+	consumer, err := env.NewConsumer(cfutil.ConsumerConfig{
+		QueueName: "jobs",
+		Dialer:    broker.Dial,
+		Backoff:   fastBackoff,
+		MessageHandler: func(ctx context.Context, d amqp.Delivery) error {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				// The second ack closes the channel with PRECONDITION_FAILED
+				d.Ack(false)
+			}
+			return nil
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, consumer.Start())
+	defer consumer.Stop()
+
+	conn, _ := broker.Dial(broker.URI(), nil)
+	ch, _ := conn.Channel()
+	assert.NoError(t, ch.Publish("", "jobs", false, false, amqp.Publishing{Body: []byte("1")}))
+	waitFor(t, func() bool { return atomic.LoadInt32(&calls) == 1 })
+	assert.NoError(t, ch.Publish("", "jobs", false, false, amqp.Publishing{Body: []byte("2")}))
+	waitFor(t, func() bool { return atomic.LoadInt32(&calls) == 2 })
+	waitFor(t, func() bool {
+		q, _ := broker.Queue("jobs")
+		return q.Consumers == 1 && q.Ready == 0 && q.Unacked == 0
+	})
+}
+
+// contextHook records the correlation ID of the context of each event
+type contextHook struct {
+	cfutil.NopEventHook
+	mu     sync.Mutex
+	events []string
+}
+
+func (h *contextHook) record(ctx context.Context, event string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	id, _ := ctx.Value(cfutil.KeyCorrelationID).(string)
+	h.events = append(h.events, event+" "+id)
+}
+
+func (h *contextHook) Connected(ctx context.Context) { h.record(ctx, "connected") }
+func (h *contextHook) Disconnected(ctx context.Context, err error) {
+	h.record(ctx, "disconnected")
+}
+func (h *contextHook) Declared(ctx context.Context, kind, name string) {
+	h.record(ctx, "declared "+name)
+}
+
+func (h *contextHook) recorded() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.events...)
+}
+
+func TestEventHookContext(t *testing.T) {
+	broker := cfutiltest.NewBroker()
+	env, err := broker.Environment()
+	if !assert.NoError(t, err) {
+		return
+	}
+	producerHook, consumerHook := &contextHook{}, &contextHook{}
+	producer, err := env.NewProducer(cfutil.ProducerConfig{
+		Exchange:     "orders",
+		ExchangeType: amqp.ExchangeTopic,
+		Dialer:       broker.Dial,
+		Backoff:      fastBackoff,
+		EventHook:    producerHook,
+		Context:      context.WithValue(context.Background(), cfutil.KeyCorrelationID, "producer"),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer producer.Close()
+	consumer, err := env.NewConsumer(cfutil.ConsumerConfig{
+		QueueName:      "jobs",
+		Dialer:         broker.Dial,
+		Backoff:        fastBackoff,
+		EventHook:      consumerHook,
+		Context:        context.WithValue(context.Background(), cfutil.KeyCorrelationID, "consumer"),
+		MessageHandler: func(ctx context.Context, d amqp.Delivery) error { return nil },
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, consumer.Start())
+	defer consumer.Stop()
+
+	// Declarations made while publishing get the context of the publish
+	ctx := context.WithValue(context.Background(), cfutil.KeyCorrelationID, "publish")
+	assert.NoError(t, producer.PublishDelayed(ctx, "orders", "order.created", amqp.Publishing{}, time.Second))
+
+	broker.Disconnect()
+	waitFor(t, func() bool { return len(producerHook.recorded()) == 7 && len(consumerHook.recorded()) == 5 })
+	assert.Equal(t, []string{
+		"declared orders producer",
+		"connected producer",
+		"declared orders.delay.1000 publish",
+		"declared orders.delay.1000 publish",
+		"disconnected producer",
+		"declared orders producer",
+		"connected producer",
+	}, producerHook.recorded())
+	assert.Equal(t, []string{
+		"connected consumer",
+		"declared jobs consumer",
+		"disconnected consumer",
+		"connected consumer",
+		"declared jobs consumer",
+	}, consumerHook.recorded())
+}
+
+// flakyConn fails the publish numbered `failAt` on its channels
+type flakyConn struct {
+	cfutil.AMQPConnection
+	publishes *int32
+	failAt    int32
+}
+
+func (c flakyConn) Channel() (cfutil.AMQPChannel, error) {
+	ch, err := c.AMQPConnection.Channel()
+	return flakyChannel{ch, c}, err
+}
+
+type flakyChannel struct {
+	cfutil.AMQPChannel
+	conn flakyConn
+}
+
+func (ch flakyChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if atomic.AddInt32(ch.conn.publishes, 1) == ch.conn.failAt {
+		return amqp.ErrClosed
+	}
+	return ch.AMQPChannel.Publish(exchange, key, mandatory, immediate, msg)
+}
+
+func TestProducerFlushFailure(t *testing.T) {
+	broker := cfutiltest.NewBroker()
+	env, err := broker.Environment()
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn, _ := broker.Dial(broker.URI(), nil)
+	ch, _ := conn.Channel()
+	ch.QueueDeclare("jobs", true, false, false, false, nil)
+
+	var down, publishes int32
+	producer, err := env.NewProducer(cfutil.ProducerConfig{
+		Backoff:    fastBackoff,
+		BufferSize: 10,
+		Dialer: func(uri string, tlsConfig *tls.Config) (cfutil.AMQPConnection, error) {
+			if atomic.LoadInt32(&down) == 1 {
+				return nil, errors.New("connection refused")
+			}
+			conn, err := broker.Dial(uri, tlsConfig)
+			return flakyConn{conn, &publishes, 2}, err
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer producer.Close()
+
+	atomic.StoreInt32(&down, 1)
+	broker.Disconnect()
+	waitFor(t, func() bool { return producer.State() == cfutil.StateReconnecting })
+	ctx := context.Background()
+	for _, body := range []string{"1", "2", "3"} {
+		assert.NoError(t, producer.Publish(ctx, "", "jobs", amqp.Publishing{Body: []byte(body)}))
+	}
+
+	// The flush fails at the second message, the rest is sent after reconnecting again
+	atomic.StoreInt32(&down, 0)
+	waitFor(t, func() bool { return len(broker.Messages("jobs")) == 3 })
+	var bodies []string
+	for _, m := range broker.Messages("jobs") {
+		bodies = append(bodies, string(m.Body))
+	}
+	assert.Equal(t, []string{"1", "2", "3"}, bodies)
+	assert.Equal(t, cfutil.StateConnected, producer.State())
+}
+
+func TestProducerConsumer(t *testing.T) {
+	broker := cfutiltest.NewBroker()
+	env, err := broker.Environment()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var calls int32
+	consumer, err := env.NewConsumer(cfutil.ConsumerConfig{
+		Exchange:     "orders",
+		ExchangeType: amqp.ExchangeTopic,
+		QueueName:    "orders.created",
+		RoutingKey:   "order.created",
+		Dialer:       broker.Dial,
+		Backoff:      fastBackoff,
+		RetryPolicy:  cfutil.RetryPolicy{MaxAttempts: 2, DeadLetterExchange: "orders.dlx"},
+		MessageHandler: func(ctx context.Context, d amqp.Delivery) error {
+			atomic.AddInt32(&calls, 1)
+			if string(d.Body) == "bad" {
+				return errors.New("cannot handle")
+			}
+			return nil
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, consumer.Start())
+	defer consumer.Stop()
+
+	conn, _ := broker.Dial(broker.URI(), nil)
+	ch, _ := conn.Channel()
+	ch.ExchangeDeclare("orders.dlx", amqp.ExchangeFanout, true, false, false, false, nil)
+	ch.QueueDeclare("orders.dead", true, false, false, false, nil)
+	ch.QueueBind("orders.dead", "", "orders.dlx", false, nil)
+
+	producer, err := env.NewProducer(cfutil.ProducerConfig{
+		Exchange:     "orders",
+		ExchangeType: amqp.ExchangeTopic,
+		Dialer:       broker.Dial,
+		Backoff:      fastBackoff,
+		BufferSize:   10,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer producer.Close()
+
+	ctx := context.WithValue(context.Background(), cfutil.KeyCorrelationID, "abc")
+	assert.NoError(t, producer.Publish(ctx, "orders", "order.created", amqp.Publishing{Body: []byte("good")}))
+	assert.NoError(t, producer.Publish(ctx, "orders", "order.created", amqp.Publishing{Body: []byte("bad")}))
+	waitFor(t, func() bool { return len(broker.Messages("orders.dead")) == 1 })
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	dead := broker.Messages("orders.dead")[0]
+	assert.Equal(t, "abc", dead.Headers[cfutil.CorrelationIDHeader])
+	assert.Equal(t, int64(2), dead.Headers[cfutil.RetryCountHeader])
+
+	assert.NoError(t, producer.PublishConfirmed(ctx, "orders", "order.created", amqp.Publishing{Body: []byte("good")}))
+	err = producer.PublishConfirmed(ctx, "orders", "order.unknown", amqp.Publishing{})
+	assert.True(t, errors.Is(err, cfutil.ErrPublishReturned))
+	// A channel exception is not mistaken for a lost connection
+	err = producer.PublishConfirmed(ctx, "missing", "order.created", amqp.Publishing{})
+	var exception *amqp.Error
+	if assert.True(t, errors.As(err, &exception)) {
+		assert.Equal(t, amqp.NotFound, exception.Code)
+	}
+	assert.NoError(t, producer.PublishConfirmed(ctx, "orders", "order.created", amqp.Publishing{Body: []byte("good")}))
+
+	// Both reconnect after the broker drops all connections
+	broker.Disconnect()
+	waitFor(t, func() bool { return producer.State() == cfutil.StateConnected })
+	waitFor(t, func() bool {
+		q, _ := broker.Queue("orders.created")
+		return q.Consumers == 1
+	})
+	assert.NoError(t, producer.Publish(ctx, "orders", "order.created", amqp.Publishing{Body: []byte("good")}))
+	waitFor(t, func() bool { return atomic.LoadInt32(&calls) == 6 })
+	// The confirm channel of the old connection is not reused
+	assert.NoError(t, producer.PublishConfirmed(ctx, "orders", "order.created", amqp.Publishing{Body: []byte("good")}))
+	waitFor(t, func() bool { return atomic.LoadInt32(&calls) == 7 })
+}
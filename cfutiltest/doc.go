@@ -0,0 +1,3 @@
+// Package cfutiltest provides fakes of the services cfutil talks to,
+// for use in unit tests of apps built on cfutil.
+package cfutiltest
@@ -0,0 +1,232 @@
+package cfutiltest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/loafoe/cfutil"
+)
+
+// RabbitMQAdminServer is an in-memory fake of the RabbitMQ management API.
+// It supports the endpoints used by cfutil.RabbitMQAdmin.
+type RabbitMQAdminServer struct {
+	*httptest.Server
+	Username string
+	Password string
+
+	mu       sync.Mutex
+	overview cfutil.Overview
+	queues   map[string]*cfutil.QueueInfo
+	policies map[string]cfutil.Policy
+	shovels  map[string]cfutil.Shovel
+}
+
+// NewRabbitMQAdminServer() starts a fake management API accepting
+// `guest`/`guest` as credentials. Call Close() when done.
+func NewRabbitMQAdminServer() *RabbitMQAdminServer {
+	s := &RabbitMQAdminServer{
+		Username: "guest",
+		Password: "guest",
+		queues:   map[string]*cfutil.QueueInfo{},
+		policies: map[string]cfutil.Policy{},
+		shovels:  map[string]cfutil.Shovel{},
+	}
+	s.overview.ClusterName = "rabbit@localhost"
+	s.overview.RabbitMQVersion = "3.8.0"
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// URI() returns the management URI including credentials, as it
+// would appear in the `protocols.management.uri` credential
+func (s *RabbitMQAdminServer) URI() string {
+	u, _ := url.Parse(s.Server.URL)
+	u.User = url.UserPassword(s.Username, s.Password)
+	u.Path = "/api/"
+	return u.String()
+}
+
+// Client() returns a cfutil.RabbitMQAdmin talking to the fake
+func (s *RabbitMQAdminServer) Client() *cfutil.RabbitMQAdmin {
+	admin, _ := cfutil.NewRabbitMQAdminFromURI(s.URI())
+	admin.HTTPClient = s.Server.Client()
+	return admin
+}
+
+// SetQueue() adds or replaces a queue, VHost defaults to `/`
+func (s *RabbitMQAdminServer) SetQueue(queue cfutil.QueueInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if queue.VHost == "" {
+		queue.VHost = "/"
+	}
+	if queue.State == "" {
+		queue.State = "running"
+	}
+	queue.Messages = queue.MessagesReady + queue.MessagesUnacknowledged
+	s.queues[key(queue.VHost, queue.Name)] = &queue
+}
+
+// SetOverview() replaces the statistics returned by the overview endpoint
+func (s *RabbitMQAdminServer) SetOverview(overview cfutil.Overview) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.overview = overview
+}
+
+// Policies() returns the policies that were put
+func (s *RabbitMQAdminServer) Policies() []cfutil.Policy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	policies := []cfutil.Policy{}
+	for _, p := range s.policies {
+		policies = append(policies, p)
+	}
+	return policies
+}
+
+// Shovels() returns the shovels that were put
+func (s *RabbitMQAdminServer) Shovels() []cfutil.Shovel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	shovels := []cfutil.Shovel{}
+	for _, sh := range s.shovels {
+		shovels = append(shovels, sh)
+	}
+	return shovels
+}
+
+func (s *RabbitMQAdminServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, pass, ok := r.BasicAuth(); !ok || user != s.Username || pass != s.Password {
+		writeError(w, http.StatusUnauthorized, "Not_Authorized")
+		return
+	}
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.EscapedPath(), "/api"), "/"), "/")
+	for i := range parts {
+		parts[i], _ = url.PathUnescape(parts[i])
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case len(parts) == 1 && parts[0] == "overview" && r.Method == http.MethodGet:
+		overview := s.overview
+		overview.ObjectTotals.Queues = len(s.queues)
+		writeJSON(w, overview)
+	case parts[0] == "queues" && r.Method == http.MethodGet && len(parts) <= 2:
+		queues := []cfutil.QueueInfo{}
+		for _, q := range s.queues {
+			if len(parts) == 1 || q.VHost == parts[1] {
+				queues = append(queues, *q)
+			}
+		}
+		writeJSON(w, queues)
+	case parts[0] == "queues" && len(parts) >= 3:
+		q, ok := s.queues[key(parts[1], parts[2])]
+		if !ok {
+			writeError(w, http.StatusNotFound, "Not Found")
+			return
+		}
+		switch {
+		case len(parts) == 3 && r.Method == http.MethodGet:
+			writeJSON(w, q)
+		case len(parts) == 4 && parts[3] == "contents" && r.Method == http.MethodDelete:
+			q.Messages -= q.MessagesReady
+			q.MessagesReady = 0
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		}
+	case parts[0] == "policies" && len(parts) == 2 && r.Method == http.MethodGet:
+		policies := []cfutil.Policy{}
+		for _, p := range s.policies {
+			if p.VHost == parts[1] {
+				policies = append(policies, p)
+			}
+		}
+		writeJSON(w, policies)
+	case parts[0] == "policies" && len(parts) == 3:
+		s.serveItem(w, r, parts[1], parts[2], func(vhost, name string, body []byte) error {
+			var p cfutil.Policy
+			if err := json.Unmarshal(body, &p); err != nil {
+				return err
+			}
+			p.VHost, p.Name = vhost, name
+			s.policies[key(vhost, name)] = p
+			return nil
+		}, func(k string) bool {
+			_, ok := s.policies[k]
+			delete(s.policies, k)
+			return ok
+		})
+	case len(parts) == 3 && parts[0] == "parameters" && parts[1] == "shovel" && r.Method == http.MethodGet:
+		shovels := []cfutil.Shovel{}
+		for _, sh := range s.shovels {
+			if sh.VHost == parts[2] {
+				shovels = append(shovels, sh)
+			}
+		}
+		writeJSON(w, shovels)
+	case len(parts) == 4 && parts[0] == "parameters" && parts[1] == "shovel":
+		s.serveItem(w, r, parts[2], parts[3], func(vhost, name string, body []byte) error {
+			var sh cfutil.Shovel
+			if err := json.Unmarshal(body, &sh); err != nil {
+				return err
+			}
+			sh.VHost, sh.Name = vhost, name
+			s.shovels[key(vhost, name)] = sh
+			return nil
+		}, func(k string) bool {
+			_, ok := s.shovels[k]
+			delete(s.shovels, k)
+			return ok
+		})
+	default:
+		writeError(w, http.StatusNotFound, "Not Found")
+	}
+}
+
+// serveItem handles PUT and DELETE of a named item in a vhost
+func (s *RabbitMQAdminServer) serveItem(w http.ResponseWriter, r *http.Request, vhost, name string,
+	put func(vhost, name string, body []byte) error, remove func(key string) bool) {
+	switch r.Method {
+	case http.MethodPut:
+		var body json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := put(vhost, name, body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		if !remove(key(vhost, name)) {
+			writeError(w, http.StatusNotFound, "Not Found")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+	}
+}
+
+func key(vhost, name string) string {
+	return vhost + "/" + name
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": http.StatusText(status), "reason": reason})
+}
@@ -24,6 +24,9 @@ func (client *ConsulClient) Services() ([]string, error) {
 	return services, nil
 }
 
+// DiscoverServiceURL() returns the URL of the first instance of `serviceName`
+// in the catalog, regardless of its health. Use a ServiceResolver to spread
+// requests over the healthy instances instead.
 func (client *ConsulClient) DiscoverServiceURL(serviceName, tags string) (string, error) {
 	services, _, err := client.Catalog().Service(serviceName, tags, nil)
 	if err != nil {
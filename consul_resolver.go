@@ -0,0 +1,251 @@
+package cfutil
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// LoadBalancing is the way a ServiceResolver picks an instance
+type LoadBalancing int
+
+const (
+	// RoundRobin picks the instances in turn
+	RoundRobin LoadBalancing = iota
+	// Random picks a random instance
+	Random
+)
+
+// DefaultConsulWaitTime is the maximum duration of a blocking query of a ServiceResolver
+const DefaultConsulWaitTime = 5 * time.Minute
+
+// ConsulScheme is the URL scheme resolved by a ConsulTransport
+const ConsulScheme = "consul"
+
+type ServiceResolverConfig struct {
+	// Tag limits the instances to those with this tag, if set
+	Tag string
+	// LoadBalancing is RoundRobin by default
+	LoadBalancing LoadBalancing
+	// WaitTime bounds each blocking query, DefaultConsulWaitTime when zero
+	WaitTime time.Duration
+	// Backoff controls the delay between queries after an error, DefaultBackoff when empty
+	Backoff Backoff
+	// Logger receives diagnostics, DefaultLogger when nil
+	Logger Logger
+}
+
+// ServiceResolver keeps a live list of the instances of a service passing
+// their health checks, using blocking queries on the Consul Health endpoint,
+// and spreads requests over them
+type ServiceResolver struct {
+	client  *ConsulClient
+	service string
+	config  ServiceResolverConfig
+	log     Logger
+	next    uint32
+
+	mu        sync.RWMutex
+	instances []*consul.ServiceEntry
+	err       error
+	ready     chan struct{} // closed after the first query
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+// NewServiceResolver() returns a ServiceResolver for `service` which watches
+// Consul in the background until Close() is called
+func (client *ConsulClient) NewServiceResolver(service string, config ServiceResolverConfig) *ServiceResolver {
+	if config.WaitTime <= 0 {
+		config.WaitTime = DefaultConsulWaitTime
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &ServiceResolver{
+		client:  client,
+		service: service,
+		config:  config,
+		log:     config.Logger,
+		ready:   make(chan struct{}),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	if r.log == nil {
+		r.log = defaultLogger
+	}
+	go r.watch(ctx)
+	return r
+}
+
+// Instances() returns the instances passing their health checks
+func (r *ServiceResolver) Instances() []*consul.ServiceEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.instances
+}
+
+// Resolve() returns the URL of the next instance of the service. Before the
+// first query completed it waits for it until `ctx` is done.
+func (r *ServiceResolver) Resolve(ctx context.Context) (string, error) {
+	select {
+	case <-r.ready:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	r.mu.RLock()
+	instances, err := r.instances, r.err
+	r.mu.RUnlock()
+	if len(instances) == 0 {
+		if err != nil {
+			return "", fmt.Errorf("Service `%s` not found: %s", r.service, err)
+		}
+		return "", fmt.Errorf("Service `%s` not found", r.service)
+	}
+	var i int
+	switch r.config.LoadBalancing {
+	case Random:
+		i = rand.Intn(len(instances))
+	default:
+		i = int((atomic.AddUint32(&r.next, 1) - 1) % uint32(len(instances)))
+	}
+	return CreateURLFromServiceEntry(instances[i])
+}
+
+// Close() stops watching Consul
+func (r *ServiceResolver) Close() {
+	r.cancel()
+	<-r.done
+}
+
+// watch runs blocking queries until `ctx` is done
+func (r *ServiceResolver) watch(ctx context.Context) {
+	defer close(r.done)
+	var index uint64
+	var once sync.Once
+	for attempt := 0; ; {
+		opts := &consul.QueryOptions{WaitIndex: index, WaitTime: r.config.WaitTime}
+		entries, meta, err := r.client.Health().Service(r.service, r.config.Tag, true, opts.WithContext(ctx))
+		if ctx.Err() != nil {
+			return
+		}
+		r.mu.Lock()
+		if err != nil {
+			r.err = err
+		} else {
+			r.instances, r.err = entries, nil
+		}
+		r.mu.Unlock()
+		once.Do(func() { close(r.ready) })
+
+		if err != nil {
+			r.log.Warning(ctx, "Watching service `%s` failed: %v", r.service, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(r.config.Backoff.Delay(attempt)):
+			}
+			attempt++
+			continue
+		}
+		attempt = 0
+		// The index can go backwards, e.g. after a Consul snapshot restore
+		if meta.LastIndex < index {
+			index = 0
+		} else {
+			index = meta.LastIndex
+		}
+		// An index of 0 does not block, which would make this a busy loop
+		if index < 1 {
+			index = 1
+		}
+	}
+}
+
+// CreateURLFromServiceEntry() returns the URL of the instance in `entry`,
+// using the node address when the service has none
+func CreateURLFromServiceEntry(entry *consul.ServiceEntry) (string, error) {
+	address := entry.Service.Address
+	if address == "" && entry.Node != nil {
+		address = entry.Node.Address
+	}
+	return CreateURLFromServiceCatalog(&consul.CatalogService{
+		ServiceAddress: address,
+		ServicePort:    entry.Service.Port,
+	})
+}
+
+// ConsulTransport is an http.RoundTripper resolving `consul://service-name/path`
+// URLs to an instance of the service, other URLs are passed on as is.
+// A ServiceResolver is started for each service on first use.
+type ConsulTransport struct {
+	client *ConsulClient
+	config ServiceResolverConfig
+	base   http.RoundTripper
+
+	mu        sync.Mutex
+	resolvers map[string]*ServiceResolver
+}
+
+// NewTransport() returns a ConsulTransport sending requests with `base`,
+// http.DefaultTransport when nil. Use it in an http.Client:
+//
+//	client := &http.Client{Transport: consulClient.NewTransport(cfutil.ServiceResolverConfig{}, nil)}
+//	resp, err := client.Get("consul://orders/api/orders")
+func (client *ConsulClient) NewTransport(config ServiceResolverConfig, base http.RoundTripper) *ConsulTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &ConsulTransport{
+		client:    client,
+		config:    config,
+		base:      base,
+		resolvers: map[string]*ServiceResolver{},
+	}
+}
+
+// RoundTrip() implements http.RoundTripper
+func (t *ConsulTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != ConsulScheme {
+		return t.base.RoundTrip(req)
+	}
+	instance, err := t.resolver(req.URL.Hostname()).Resolve(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	target, err := url.Parse(instance)
+	if err != nil {
+		return nil, err
+	}
+	resolved := req.Clone(req.Context())
+	resolved.URL.Scheme = target.Scheme
+	resolved.URL.Host = target.Host
+	resolved.Host = target.Host
+	return t.base.RoundTrip(resolved)
+}
+
+// Close() stops all ServiceResolvers of the ConsulTransport
+func (t *ConsulTransport) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for service, r := range t.resolvers {
+		r.Close()
+		delete(t.resolvers, service)
+	}
+}
+
+func (t *ConsulTransport) resolver(service string) *ServiceResolver {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.resolvers[service]
+	if !ok {
+		r = t.client.NewServiceResolver(service, t.config)
+		t.resolvers[service] = r
+	}
+	return r
+}
@@ -0,0 +1,193 @@
+package cfutil_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/loafoe/cfutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConsul serves the status and health endpoints with blocking queries
+type fakeConsul struct {
+	mu        sync.Mutex
+	queries   int
+	index     uint64
+	instances map[string][]*consul.ServiceEntry
+	changed   chan struct{}
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{index: 1, instances: map[string][]*consul.ServiceEntry{}, changed: make(chan struct{})}
+}
+
+func (f *fakeConsul) setInstances(service string, addresses ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var entries []*consul.ServiceEntry
+	for _, address := range addresses {
+		parts := strings.Split(address, ":")
+		port, _ := strconv.Atoi(parts[1])
+		entries = append(entries, &consul.ServiceEntry{
+			Node:    &consul.Node{Node: "node", Address: "10.0.0.1"},
+			Service: &consul.AgentService{Service: service, Address: parts[0], Port: port},
+		})
+	}
+	f.instances[service] = entries
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v1/status/leader":
+		fmt.Fprint(w, `"127.0.0.1:8300"`)
+	case strings.HasPrefix(r.URL.Path, "/v1/health/service/"):
+		if r.URL.Query().Get("passing") != "1" {
+			http.Error(w, "passing only expected", http.StatusBadRequest)
+			return
+		}
+		wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+		index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+		f.mu.Lock()
+		f.queries++
+		// Like Consul a query without index returns right away
+		if index > 0 && index >= f.index {
+			changed := f.changed
+			f.mu.Unlock()
+			select {
+			case <-changed:
+			case <-time.After(wait):
+			case <-r.Context().Done():
+				return
+			}
+			f.mu.Lock()
+		}
+		entries := f.instances[strings.TrimPrefix(r.URL.Path, "/v1/health/service/")]
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+		f.mu.Unlock()
+		if entries == nil {
+			entries = []*consul.ServiceEntry{}
+		}
+		json.NewEncoder(w).Encode(entries)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestServiceResolver(t *testing.T) {
+	fake := newFakeConsul()
+	fake.setInstances("orders", "10.0.0.2:8080", "10.0.0.3:8080")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client, err := cfutil.NewConsulClient(server.URL, "test", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	resolver := client.NewServiceResolver("orders", cfutil.ServiceResolverConfig{WaitTime: time.Second})
+	defer resolver.Close()
+
+	ctx := context.Background()
+	var urls []string
+	for i := 0; i < 4; i++ {
+		u, err := resolver.Resolve(ctx)
+		assert.NoError(t, err)
+		urls = append(urls, u)
+	}
+	assert.Equal(t, []string{"http://10.0.0.2:8080", "http://10.0.0.3:8080", "http://10.0.0.2:8080", "http://10.0.0.3:8080"}, urls)
+
+	// Changes arrive through the blocking query
+	fake.setInstances("orders", ":8080", "orders.example.com:443")
+	deadline := time.Now().Add(2 * time.Second)
+	for len(resolver.Instances()) != 2 || resolver.Instances()[0].Service.Address != "" {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for update")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		u, _ := resolver.Resolve(ctx)
+		seen[u] = true
+	}
+	assert.Equal(t, map[string]bool{"http://10.0.0.1:8080": true, "https://orders.example.com": true}, seen)
+
+	missing := client.NewServiceResolver("missing", cfutil.ServiceResolverConfig{LoadBalancing: cfutil.Random})
+	defer missing.Close()
+	_, err = missing.Resolve(ctx)
+	assert.Error(t, err)
+}
+
+func TestServiceResolverZeroIndex(t *testing.T) {
+	fake := newFakeConsul()
+	fake.index = 0
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client, err := cfutil.NewConsulClient(server.URL, "test", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	resolver := client.NewServiceResolver("orders", cfutil.ServiceResolverConfig{WaitTime: time.Second})
+	time.Sleep(100 * time.Millisecond)
+	resolver.Close()
+
+	// The index is raised to 1 so the queries keep blocking
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	assert.True(t, fake.queries <= 2, "%d queries", fake.queries)
+}
+
+func TestConsulTransport(t *testing.T) {
+	var mu sync.Mutex
+	var hosts []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hosts = append(hosts, r.Host)
+		mu.Unlock()
+		fmt.Fprint(w, r.URL.RequestURI())
+	}))
+	defer backend.Close()
+
+	fake := newFakeConsul()
+	fake.setInstances("orders", strings.TrimPrefix(backend.URL, "http://"))
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	client, err := cfutil.NewConsulClient(server.URL, "test", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	transport := client.NewTransport(cfutil.ServiceResolverConfig{}, nil)
+	defer transport.Close()
+	httpClient := &http.Client{Transport: transport}
+
+	resp, err := httpClient.Get("consul://orders/api/orders?page=2")
+	if assert.NoError(t, err) {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "/api/orders?page=2", string(body))
+		assert.Equal(t, []string{strings.TrimPrefix(backend.URL, "http://")}, hosts)
+	}
+
+	_, err = httpClient.Get("consul://unknown/")
+	assert.Error(t, err)
+
+	// Other schemes are passed on
+	resp, err = httpClient.Get(backend.URL + "/direct")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,347 @@
+package cfutil
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	cfenv "github.com/cloudfoundry-community/go-cfenv"
+)
+
+// CredHubRefKey is the credential key Cloudfoundry uses to refer to
+// credentials stored in CredHub instead of embedding them in VCAP_SERVICES
+const CredHubRefKey = "credhub-ref"
+
+// CredentialResolver resolves a CredHub style credential reference
+// such as `/c/broker/service/instance/credentials` to its value
+type CredentialResolver interface {
+	Resolve(ctx context.Context, ref string) (interface{}, error)
+}
+
+// StaticCredentialResolver resolves references from an in-memory map.
+// It is meant for tests and local development.
+type StaticCredentialResolver map[string]interface{}
+
+func (r StaticCredentialResolver) Resolve(ctx context.Context, ref string) (interface{}, error) {
+	value, ok := r[ref]
+	if !ok {
+		return nil, fmt.Errorf("Credential reference not found: %s", ref)
+	}
+	return value, nil
+}
+
+// CredHubClient resolves credential references using the CredHub API
+type CredHubClient struct {
+	URL        string
+	HTTPClient *http.Client
+}
+
+// NewCredHubClient() returns a CredHubClient for the CredHub API at `apiURL`,
+// defaulting to the `CREDHUB_API` environment variable. It authenticates using
+// the instance identity certificate in `CF_INSTANCE_CERT` and `CF_INSTANCE_KEY`,
+// which is read again for every connection as Cloudfoundry rotates it.
+func NewCredHubClient(apiURL string) (*CredHubClient, error) {
+	if apiURL == "" {
+		apiURL = os.Getenv("CREDHUB_API")
+	}
+	if apiURL == "" {
+		return nil, errors.New("CredHub API URL not set")
+	}
+	certFile, keyFile := os.Getenv("CF_INSTANCE_CERT"), os.Getenv("CF_INSTANCE_KEY")
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("Instance identity certificate not available")
+	}
+	loadCertificate := func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading instance identity certificate: %s", err.Error())
+		}
+		return &cert, nil
+	}
+	if _, err := loadCertificate(nil); err != nil {
+		return nil, err
+	}
+	return &CredHubClient{
+		URL: strings.TrimSuffix(apiURL, "/"),
+		HTTPClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					GetClientCertificate: loadCertificate,
+				},
+			},
+		},
+	}, nil
+}
+
+func (c *CredHubClient) Resolve(ctx context.Context, ref string) (interface{}, error) {
+	req, err := http.NewRequest(http.MethodGet, c.URL+"/api/v1/data?current=true&name="+url.QueryEscape(ref), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CredHub returned %s for %s", resp.Status, ref)
+	}
+	var result struct {
+		Data []struct {
+			Value interface{} `json:"value"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("Error decoding CredHub response: %s", err.Error())
+	}
+	if len(result.Data) == 0 {
+		return nil, fmt.Errorf("Credential reference not found: %s", ref)
+	}
+	return result.Data[0].Value, nil
+}
+
+// ResolveCredentials() resolves all credential references in the
+// DefaultEnvironment() and makes the result the new default
+func ResolveCredentials(ctx context.Context, resolver CredentialResolver) error {
+	env, err := DefaultEnvironment()
+	if err != nil {
+		return err
+	}
+	resolved, err := env.ResolveCredentials(ctx, resolver)
+	if err != nil {
+		return err
+	}
+	SetDefaultEnvironment(resolved)
+	return nil
+}
+
+// ResolveCredentials() returns a copy of the Environment in which all
+// `credhub-ref` entries in service credentials are replaced by the values
+// `resolver` returns for them. The original Environment is left untouched.
+func (e *Environment) ResolveCredentials(ctx context.Context, resolver CredentialResolver) (*Environment, error) {
+	services, err := resolveServices(ctx, resolver, e.Services)
+	if err != nil {
+		return nil, err
+	}
+	app := *e.App
+	app.Services = services
+	env := *e
+	env.App = &app
+	env.credentials = nil
+	return &env, nil
+}
+
+// WithCredentialResolver() returns a copy of the Environment which resolves
+// `credhub-ref` credentials with `resolver` the first time a service is looked
+// up, so they are available to all functions finding or binding services.
+// Only looking up a service whose references cannot be resolved fails.
+// NewEnvironment() sets a CredHub resolver when VCAP_SERVICES has references.
+func (e *Environment) WithCredentialResolver(resolver CredentialResolver) *Environment {
+	env := *e
+	env.credentials = &credentialState{
+		resolver: resolver,
+		resolved: make(map[string]cfenv.Service),
+		failed:   make(map[string]error),
+	}
+	return &env
+}
+
+// credentialState caches the services with resolved credentials by name
+type credentialState struct {
+	resolver CredentialResolver
+	mu       sync.Mutex
+	resolved map[string]cfenv.Service
+	failed   map[string]error // why resolving the credentials of a service failed last time
+}
+
+// services returns the services of the Environment, with their credential
+// references resolved when a resolver is set. Services that cannot be resolved
+// are returned as they are, see credentialError(). Failures are retried on next use.
+func (e *Environment) services() cfenv.Services {
+	if e.credentials == nil || !hasCredentialRefs(e.Services) {
+		return e.Services
+	}
+	c := e.credentials
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	services := make(cfenv.Services, len(e.Services))
+	for label, instances := range e.Services {
+		resolved := make([]cfenv.Service, len(instances))
+		for i, service := range instances {
+			resolved[i] = c.resolve(service)
+		}
+		services[label] = resolved
+	}
+	return services
+}
+
+// resolve returns `service` with its credential references resolved,
+// or unchanged when that fails
+func (c *credentialState) resolve(service cfenv.Service) cfenv.Service {
+	if !containsCredentialRef(service.Credentials) {
+		return service
+	}
+	if resolved, ok := c.resolved[service.Name]; ok {
+		return resolved
+	}
+	resolved, err := resolveService(context.Background(), c.resolver, service)
+	if err != nil {
+		c.failed[service.Name] = err
+		return service
+	}
+	delete(c.failed, service.Name)
+	c.resolved[service.Name] = resolved
+	return resolved
+}
+
+// credentialError returns why the credentials of one of `services` could not
+// be resolved, or of any service when none are given
+func (e *Environment) credentialError(services ...cfenv.Service) error {
+	if e.credentials == nil {
+		return nil
+	}
+	c := e.credentials
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(services) == 0 {
+		names := make([]string, 0, len(c.failed))
+		for name := range c.failed {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			return c.failed[name]
+		}
+	}
+	for _, service := range services {
+		if err, ok := c.failed[service.Name]; ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// credHubResolver creates the CredHubClient on first use, so apps without
+// access to CredHub only fail when they look up a service that needs it
+type credHubResolver struct {
+	mu     sync.Mutex
+	client *CredHubClient
+}
+
+func (r *credHubResolver) Resolve(ctx context.Context, ref string) (interface{}, error) {
+	r.mu.Lock()
+	if r.client == nil {
+		client, err := NewCredHubClient("")
+		if err != nil {
+			r.mu.Unlock()
+			return nil, err
+		}
+		r.client = client
+	}
+	client := r.client
+	r.mu.Unlock()
+	return client.Resolve(ctx, ref)
+}
+
+// hasCredentialRefs returns true if the credentials of any service contain a reference
+func hasCredentialRefs(services cfenv.Services) bool {
+	for _, instances := range services {
+		for _, service := range instances {
+			if containsCredentialRef(service.Credentials) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsCredentialRef(value interface{}) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if _, ok := v[CredHubRefKey].(string); ok && len(v) == 1 {
+			return true
+		}
+		for _, val := range v {
+			if containsCredentialRef(val) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, val := range v {
+			if containsCredentialRef(val) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resolveServices returns a copy of `all` with the credential references resolved
+func resolveServices(ctx context.Context, resolver CredentialResolver, all cfenv.Services) (cfenv.Services, error) {
+	services := make(cfenv.Services, len(all))
+	for label, instances := range all {
+		resolved := make([]cfenv.Service, len(instances))
+		for i, service := range instances {
+			var err error
+			if resolved[i], err = resolveService(ctx, resolver, service); err != nil {
+				return nil, err
+			}
+		}
+		services[label] = resolved
+	}
+	return services, nil
+}
+
+// resolveService returns a copy of `service` with its credential references resolved
+func resolveService(ctx context.Context, resolver CredentialResolver, service cfenv.Service) (cfenv.Service, error) {
+	value, err := resolveCredentialRefs(ctx, resolver, service.Credentials)
+	if err != nil {
+		return service, fmt.Errorf("Error resolving credentials of service '%s': %s", service.Name, err.Error())
+	}
+	credentials, ok := value.(map[string]interface{})
+	if !ok {
+		return service, fmt.Errorf("Resolved credentials of service '%s' are not an object", service.Name)
+	}
+	service.Credentials = credentials
+	return service, nil
+}
+
+func resolveCredentialRefs(ctx context.Context, resolver CredentialResolver, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if ref, ok := v[CredHubRefKey].(string); ok && len(v) == 1 {
+			return resolver.Resolve(ctx, ref)
+		}
+		resolved := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			r, err := resolveCredentialRefs(ctx, resolver, val)
+			if err != nil {
+				return nil, err
+			}
+			resolved[key] = r
+		}
+		return resolved, nil
+	case []interface{}:
+		resolved := make([]interface{}, len(v))
+		for i, val := range v {
+			r, err := resolveCredentialRefs(ctx, resolver, val)
+			if err != nil {
+				return nil, err
+			}
+			resolved[i] = r
+		}
+		return resolved, nil
+	default:
+		return v, nil
+	}
+}
@@ -1,17 +1,95 @@
 package cfutil
 
 import (
-	cfenv "github.com/cloudfoundry-community/go-cfenv"
 	"os"
+	"sync"
+
+	cfenv "github.com/cloudfoundry-community/go-cfenv"
 )
 
+// Environment holds the Cloudfoundry application environment and the
+// services bound to the app. It is built once and never touches the process
+// environment, so it is safe to share between goroutines.
+type Environment struct {
+	*cfenv.App
+	credentials *credentialState // resolves `credhub-ref` credentials on lookup, if set
+}
+
+var defaultEnvironment struct {
+	sync.Mutex
+	env *Environment
+}
+
+// NewEnvironment() builds an Environment from the process environment.
+// When `CF_LOCAL` is `true` or the app is not running in Cloudfoundry
+// the application environment and its services are simulated. Services
+// with `credhub-ref` credentials are resolved through CredHub on lookup,
+// without CredHub access only looking up those services fails.
+func NewEnvironment() (*Environment, error) {
+	vars := cfenv.CurrentEnv()
+	env, err := NewEnvironmentFromMap(vars)
+	if IsLocal() || err != nil {
+		services, servicesErr := localVcapServices()
+		if servicesErr != nil {
+			return nil, servicesErr
+		}
+		vars["VCAP_APPLICATION"] = localVcapApplication()
+		vars["MEMORY_LIMIT"] = localMemoryLimit()
+		vars["VCAP_SERVICES"] = services
+		env, err = NewEnvironmentFromMap(vars)
+	}
+	if err != nil || !hasCredentialRefs(env.Services) {
+		return env, err
+	}
+	return env.WithCredentialResolver(&credHubResolver{}), nil
+}
+
+// NewEnvironmentFromMap() builds an Environment from the given set of
+// environment variables, e.g. `VCAP_APPLICATION` and `VCAP_SERVICES`.
+func NewEnvironmentFromMap(vars map[string]string) (*Environment, error) {
+	app, err := cfenv.New(vars)
+	if err != nil {
+		return nil, err
+	}
+	return &Environment{App: app}, nil
+}
+
+// DefaultEnvironment() returns the Environment used by the package level
+// functions. It is created by NewEnvironment() on first use.
+func DefaultEnvironment() (*Environment, error) {
+	defaultEnvironment.Lock()
+	defer defaultEnvironment.Unlock()
+
+	if defaultEnvironment.env == nil {
+		env, err := NewEnvironment()
+		if err != nil {
+			return nil, err
+		}
+		defaultEnvironment.env = env
+	}
+	return defaultEnvironment.env, nil
+}
+
+// SetDefaultEnvironment() replaces the Environment used by the package level
+// functions. Passing nil causes it to be rebuilt on next use.
+func SetDefaultEnvironment(env *Environment) {
+	defaultEnvironment.Lock()
+	defer defaultEnvironment.Unlock()
+
+	defaultEnvironment.env = env
+}
+
+// Current() returns the Cloudfoundry application environment of the
+// DefaultEnvironment()
 func Current() (appEnv *cfenv.App, err error) {
-	appEnv, err = cfenv.Current()
-	if os.Getenv("CF_LOCAL") == "true" || err != nil {
-		os.Setenv("VCAP_APPLICATION", localVcapApplication())
-		os.Setenv("MEMORY_LIMIT", localMemoryLimit())
-		os.Setenv("VCAP_SERVICES", localVcapServices())
-		appEnv, err = cfenv.Current()
+	env, err := DefaultEnvironment()
+	if err != nil {
+		return nil, err
 	}
-	return appEnv, err
+	return env.App, nil
+}
+
+// IsLocal() returns true if the environment variable `CF_LOCAL` contains `true`
+func IsLocal() bool {
+	return os.Getenv("CF_LOCAL") == "true"
 }
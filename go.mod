@@ -5,16 +5,19 @@ go 1.18
 require (
 	github.com/cloudfoundry-community/go-cfenv v1.17.0
 	github.com/gemnasium/migrate v1.4.1
+	github.com/go-sql-driver/mysql v1.4.0
 	github.com/google/uuid v1.1.1
 	github.com/hashicorp/consul v1.2.2
 	github.com/hashicorp/vault v0.11.1
 	github.com/jeffail/gabs v1.0.0
 	github.com/jmoiron/sqlx v0.0.0-20180406164412-2aeb6a910c2b
 	github.com/lib/pq v0.0.0-20180327071824-d34b9ff171c2
+	github.com/mattn/go-sqlite3 v1.11.0
 	github.com/mitchellh/mapstructure v0.0.0-20180220230111-00c29f56e238
 	github.com/sirupsen/logrus v1.4.1
 	github.com/streadway/amqp v0.0.0-20180315184602-8e4aba63da9f
 	github.com/stretchr/testify v1.2.2
+	gopkg.in/yaml.v2 v2.2.1
 )
 
 require (
@@ -42,7 +45,6 @@ require (
 	github.com/duosecurity/duo_api_golang v0.0.0-20180315112207-d0530c80e49a // indirect
 	github.com/elazarl/go-bindata-assetfs v1.0.0 // indirect
 	github.com/fatih/structs v1.0.0 // indirect
-	github.com/go-sql-driver/mysql v1.4.0 // indirect
 	github.com/gocql/gocql v0.0.0-20180910092241-e898b2baaf08 // indirect
 	github.com/golang/protobuf v1.2.0 // indirect
 	github.com/golang/snappy v0.0.0-20170215233205-553a64147049 // indirect
@@ -68,7 +70,6 @@ require (
 	github.com/jefferai/jsonx v0.0.0-20160721235117-9cc31c3135ee // indirect
 	github.com/keybase/go-crypto v0.0.0-20180807163025-c84d7cbef16b // indirect
 	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
-	github.com/mattn/go-sqlite3 v1.11.0 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
 	github.com/miekg/dns v1.0.8 // indirect
 	github.com/mitchellh/copystructure v1.0.0 // indirect
@@ -104,5 +105,4 @@ require (
 	gopkg.in/fsnotify.v1 v1.4.7 // indirect
 	gopkg.in/mgo.v2 v2.0.0-20180705113604-9856a29383ce // indirect
 	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
-	gopkg.in/yaml.v2 v2.2.1 // indirect
 )
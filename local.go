@@ -3,13 +3,18 @@ package cfutil
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	cfenv "github.com/cloudfoundry-community/go-cfenv"
 	"github.com/google/uuid"
 	"github.com/jeffail/gabs"
+	"github.com/mitchellh/mapstructure"
+	yaml "gopkg.in/yaml.v2"
 )
 
 // Struct that simulates the Cloudfoundry application environment
@@ -62,9 +67,10 @@ func localMemoryLimit() string {
 	return "2G"
 }
 
-func localVcapServices() string {
+func localVcapServices() (string, error) {
 	var supportedServices = []string{
 		"postgres",
+		"mysql",
 		"smtp",
 		"rabbitmq",
 		"sentry",
@@ -91,11 +97,99 @@ func localVcapServices() string {
 			jsonObj.ArrayAppendP(serviceJSON.Data(), "user-provided")
 		}
 	}
-	return jsonObj.String()
+	if path := os.Getenv("CF_LOCAL_VCAP_FILE"); path != "" {
+		services, err := readLocalServices(path)
+		if err != nil {
+			return "", err
+		}
+		for label, instances := range services {
+			if !jsonObj.Exists(label) {
+				jsonObj.Array(label)
+			}
+			for _, instance := range instances {
+				jsonObj.ArrayAppend(instance, label)
+			}
+		}
+	}
+	return jsonObj.String(), nil
+}
+
+// LoadLocalServices() reads a VCAP_SERVICES shaped JSON or YAML document
+// from `path` and returns the services it describes. Files ending in
+// `.yml` or `.yaml` are parsed as YAML, anything else as JSON.
+// Setting `CF_LOCAL_VCAP_FILE` to such a file merges its services with
+// the ones defined through the CF_LOCAL_* environment variables.
+func LoadLocalServices(path string) (cfenv.Services, error) {
+	raw, err := readLocalServices(path)
+	if err != nil {
+		return nil, err
+	}
+	services := make(cfenv.Services)
+	for label, instances := range raw {
+		var serviceInstances []cfenv.Service
+		if err := mapstructure.WeakDecode(instances, &serviceInstances); err != nil {
+			return nil, fmt.Errorf("Error decoding services with label '%s': %s", label, err.Error())
+		}
+		services[label] = serviceInstances
+	}
+	return services, nil
+}
+
+func readLocalServices(path string) (map[string][]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("Error parsing %s: %s", path, err.Error())
+		}
+		doc = normalizeYAML(doc)
+	default:
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("Error parsing %s: %s", path, err.Error())
+		}
+	}
+	labels, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Services in %s should be an object keyed by label", path)
+	}
+	services := make(map[string][]interface{}, len(labels))
+	for label, value := range labels {
+		instances, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Services with label '%s' in %s should be a list", label, path)
+		}
+		for _, instance := range instances {
+			if m, ok := instance.(map[string]interface{}); ok && m["label"] == nil {
+				m["label"] = label
+			}
+		}
+		services[label] = instances
+	}
+	return services, nil
 }
 
-func IsLocal() bool {
-	return os.Getenv("CF_LOCAL") == "true"
+// normalizeYAML converts the map[interface{}]interface{} values produced by
+// the YAML decoder into map[string]interface{} so they can be marshalled to JSON
+func normalizeYAML(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[fmt.Sprintf("%v", key)] = normalizeYAML(val)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = normalizeYAML(v[i])
+		}
+		return v
+	default:
+		return v
+	}
 }
 
 // ListenString() returns the listen string based on the `PORT` environment variable value
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 )
@@ -30,27 +31,35 @@ type DefaultLogger struct {
 }
 
 func (l DefaultLogger) Debug(c context.Context, format string, args ...interface{}) {
-	fmt.Printf("[DEBUG]: "+format, args...)
+	printLine("[DEBUG]: "+format, args...)
 }
 
 func (l DefaultLogger) Info(c context.Context, format string, args ...interface{}) {
-	fmt.Printf("[INFO]: "+format, args...)
+	printLine("[INFO]: "+format, args...)
 }
 
 func (l DefaultLogger) Warning(c context.Context, format string, args ...interface{}) {
-	fmt.Printf("[WARNING]: "+format, args...)
+	printLine("[WARNING]: "+format, args...)
 }
 
 func (l DefaultLogger) Error(c context.Context, format string, args ...interface{}) {
-	fmt.Printf("[ERROR]: "+format, args...)
+	printLine("[ERROR]: "+format, args...)
 }
 
 func (l DefaultLogger) Critical(c context.Context, format string, args ...interface{}) {
-	fmt.Printf("[CRITICAL]: "+format, args...)
+	printLine("[CRITICAL]: "+format, args...)
 }
 
 func (l DefaultLogger) Raw(c context.Context, rawMessage string) {
-	fmt.Printf(rawMessage)
+	fmt.Print(rawMessage)
+}
+
+// printLine prints a formatted message, adding a newline when missing
+func printLine(format string, args ...interface{}) {
+	if !strings.HasSuffix(format, "\n") {
+		format += "\n"
+	}
+	fmt.Printf(format, args...)
 }
 
 var defaultLogger = DefaultLogger{}
@@ -8,14 +8,24 @@ import (
 	cfenv "github.com/cloudfoundry-community/go-cfenv"
 )
 
+// MattermostDSN() calls Environment.MattermostDSN() on the DefaultEnvironment()
 func MattermostDSN(serviceName string) (*url.URL, error) {
-	appEnv, _ := Current()
+	env, err := DefaultEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	return env.MattermostDSN(serviceName)
+}
+
+// MattermostDSN() returns the URL of the Mattermost service named `serviceName`
+// or of the first service with a `mattermost:` URI when no name is given
+func (e *Environment) MattermostDSN(serviceName string) (*url.URL, error) {
 	var service *cfenv.Service
 	var err error
 	if serviceName != "" {
-		service, err = serviceByName(appEnv, serviceName)
+		service, err = e.serviceByName(serviceName)
 	} else {
-		service, err = firstMatchingServiceURN(appEnv, "mattermost:")
+		service, err = e.firstMatchingServiceURN("mattermost:")
 	}
 	if err != nil {
 		return nil, err
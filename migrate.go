@@ -1,12 +1,516 @@
 package cfutil
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gemnasium/migrate/file"
 	"github.com/gemnasium/migrate/migrate"
+
+	_ "github.com/gemnasium/migrate/driver/postgres" // PostgreSQL migrations
 )
 
+// DefaultMigrationLockTimeout is the time MigrateWithLock() waits for
+// other instances to finish migrating when `ctx` has no deadline
+const DefaultMigrationLockTimeout = 5 * time.Minute
+
+// migrationLockID identifies the lock taken while migrating
+const migrationLockID = 0x63667574696c // "cfutil"
+
+// migrationLogTable holds the app instance that last migrated the schema
+const migrationLogTable = "cfutil_migration_log"
+
+// MigrationReport describes the outcome of MigrateWithLock()
+type MigrationReport struct {
+	InstanceIndex int           // index of the app instance that migrated to ToVersion, -1 if unknown
+	InstanceID    string        // ID of the app instance that migrated to ToVersion
+	MigratedAt    time.Time     // time that instance finished migrating
+	FromVersion   uint64        // schema version before migrating
+	ToVersion     uint64        // schema version after migrating
+	Migrated      bool          // true if this instance applied migrations
+	Waited        time.Duration // time spent waiting for the lock
+	Duration      time.Duration // time spent migrating
+}
+
 // Migrate() starts a database migration for the given
 // database specified in `connectString`. It looks in the `path`
 // for the migration files.
 func Migrate(connectString, path string) ([]error, bool) {
 	return migrate.UpSync(connectString, path)
 }
+
+// MigrateWithLock() calls Environment.MigrateWithLock() on the DefaultEnvironment()
+func MigrateWithLock(ctx context.Context, conn *Connection, path string) (*MigrationReport, error) {
+	env, err := DefaultEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	return env.MigrateWithLock(ctx, conn, path)
+}
+
+// MigrateWithLock() migrates the database of `conn` using the migration
+// files in `path` while holding a database lock, so only one app instance
+// migrates at a time. Postgres uses an advisory lock and MySQL a named lock,
+// SQLite relies on its own file locking. cfutil only registers the postgres
+// migrate driver, so it builds without cgo. For other databases the app
+// imports the driver itself, e.g. `github.com/gemnasium/migrate/driver/sqlite3`.
+// Other instances wait until the lock
+// is released or `ctx` is done, after which they find nothing left to migrate.
+// The report tells whether this instance applied any migrations and which
+// instance migrated the schema to its current version, as recorded in the
+// `cfutil_migration_log` table.
+func (e *Environment) MigrateWithLock(ctx context.Context, conn *Connection, path string) (*MigrationReport, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultMigrationLockTimeout)
+		defer cancel()
+	}
+	migrationURL, err := migrationURL(conn)
+	if err != nil {
+		return nil, err
+	}
+	report := &MigrationReport{}
+
+	start := time.Now()
+	unlock, err := lockMigrations(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	report.Waited = time.Since(start)
+
+	from, err := migrate.Version(migrationURL, path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading schema version: %s", err.Error())
+	}
+	start = time.Now()
+	if errs, ok := migrate.UpSync(migrationURL, path); !ok {
+		return nil, migrationError(errs)
+	}
+	report.Duration = time.Since(start)
+	to, err := migrate.Version(migrationURL, path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading schema version: %s", err.Error())
+	}
+	report.FromVersion = uint64(from)
+	report.ToVersion = uint64(to)
+	report.Migrated = from != to
+	if report.Migrated {
+		// Recorded even when `ctx` expired while migrating
+		if err := e.recordMigration(context.Background(), conn, report.ToVersion); err != nil {
+			return nil, err
+		}
+	}
+	if err := readMigrationLog(ctx, conn, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// recordMigration stores this instance as the one that migrated the
+// schema to `version`. It is called while holding the migration lock.
+func (e *Environment) recordMigration(ctx context.Context, conn *Connection, version uint64) error {
+	if err := createMigrationLog(ctx, conn); err != nil {
+		return err
+	}
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM "+migrationLogTable); err != nil {
+		return fmt.Errorf("Error recording migration: %s", err.Error())
+	}
+	insert := tx.Rebind("INSERT INTO " + migrationLogTable + " (version, instance_index, instance_id, migrated_at) VALUES (?, ?, ?, ?)")
+	if _, err := tx.ExecContext(ctx, insert, version, e.Index, e.ID, time.Now().UTC()); err != nil {
+		return fmt.Errorf("Error recording migration: %s", err.Error())
+	}
+	return tx.Commit()
+}
+
+// readMigrationLog sets the instance that last migrated the schema in `report`
+func readMigrationLog(ctx context.Context, conn *Connection, report *MigrationReport) error {
+	report.InstanceIndex = -1
+	if err := createMigrationLog(ctx, conn); err != nil {
+		return err
+	}
+	var entry struct {
+		Version       uint64    `db:"version"`
+		InstanceIndex int       `db:"instance_index"`
+		InstanceID    string    `db:"instance_id"`
+		MigratedAt    time.Time `db:"migrated_at"`
+	}
+	err := conn.GetContext(ctx, &entry, "SELECT version, instance_index, instance_id, migrated_at FROM "+migrationLogTable)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return fmt.Errorf("Error reading migration log: %s", err.Error())
+	case entry.Version != report.ToVersion:
+		// Migrated by other means since
+		return nil
+	}
+	report.InstanceIndex = entry.InstanceIndex
+	report.InstanceID = entry.InstanceID
+	report.MigratedAt = entry.MigratedAt
+	return nil
+}
+
+func createMigrationLog(ctx context.Context, conn *Connection) error {
+	_, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+migrationLogTable+` (
+	version BIGINT NOT NULL,
+	instance_index INTEGER NOT NULL,
+	instance_id VARCHAR(255) NOT NULL,
+	migrated_at TIMESTAMP NOT NULL
+)`)
+	if err != nil {
+		return fmt.Errorf("Error creating migration log: %s", err.Error())
+	}
+	return nil
+}
+
+// migrationURL returns the URL the migrate package expects for `conn`
+func migrationURL(conn *Connection) (string, error) {
+	switch driver := conn.DriverName(); driver {
+	case "postgres":
+		return conn.ConnectString, nil
+	case "mysql", "sqlite3":
+		return driver + "://" + conn.ConnectString, nil
+	default:
+		return "", fmt.Errorf("Unsupported driver '%s'", driver)
+	}
+}
+
+// lockMigrations blocks until the migration lock is held or `ctx` is done.
+// The returned function releases the lock.
+func lockMigrations(ctx context.Context, conn *Connection) (func(), error) {
+	var lockQuery, unlockQuery string
+	var lockArgs []interface{}
+	switch conn.DriverName() {
+	case "postgres":
+		lockQuery = "SELECT pg_try_advisory_lock($1)"
+		unlockQuery = "SELECT pg_advisory_unlock($1)"
+		lockArgs = []interface{}{migrationLockID}
+	case "mysql":
+		lockQuery = "SELECT COALESCE(GET_LOCK(?, 0), 0) = 1"
+		unlockQuery = "SELECT RELEASE_LOCK(?)"
+		lockArgs = []interface{}{fmt.Sprintf("cfutil-migrate-%d", migrationLockID)}
+	default:
+		return func() {}, nil
+	}
+
+	// Session level locks belong to a single connection of the pool
+	c, err := conn.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		var locked bool
+		if err := c.QueryRowContext(ctx, lockQuery, lockArgs...).Scan(&locked); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("Error taking migration lock: %s", err.Error())
+		}
+		if locked {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			c.Close()
+			return nil, fmt.Errorf("Timeout waiting for migration lock: %s", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return func() {
+		c.ExecContext(context.Background(), unlockQuery, lockArgs...)
+		c.Close()
+	}, nil
+}
+
+func migrationError(errs []error) error {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	return fmt.Errorf("Migration failed: %s", strings.Join(messages, "; "))
+}
+
+// MigrationInfo describes a single migration
+type MigrationInfo struct {
+	Version uint64
+	Name    string
+}
+
+// MigrationState lists the applied and pending migrations of a database
+type MigrationState struct {
+	Version uint64          // current schema version
+	Applied []MigrationInfo // most recent first
+	Pending []MigrationInfo // oldest first
+}
+
+// MigrationStep describes a migration that was applied or rolled back
+type MigrationStep struct {
+	MigrationInfo
+	Direction string // `up` or `down`
+	Duration  time.Duration
+}
+
+// MigrationResult describes the outcome of MigrateFS(), MigrateTo() and MigrateDown()
+type MigrationResult struct {
+	FromVersion uint64
+	ToVersion   uint64
+	Steps       []MigrationStep
+	Duration    time.Duration
+}
+
+// MigrationStatus() returns the migrations in `migrations` that are applied to
+// and pending for the database of `conn`. Migrations are read from the root of
+// `migrations`, use os.DirFS() for a directory on disk or fs.Sub() to select a
+// directory of an embedded filesystem, e.g.
+//
+//	//go:embed migrations/*.sql
+//	var embedded embed.FS
+//
+//	migrations, _ := fs.Sub(embedded, "migrations")
+//	state, err := cfutil.MigrationStatus(conn, migrations)
+func MigrationStatus(conn *Connection, migrations fs.FS) (*MigrationState, error) {
+	source, err := openMigrationSource(conn, migrations)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+	return source.state()
+}
+
+// MigrateFS() calls Environment.MigrateFS() on the DefaultEnvironment()
+func MigrateFS(conn *Connection, migrations fs.FS) (*MigrationResult, error) {
+	env, err := DefaultEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	return env.MigrateFS(conn, migrations)
+}
+
+// MigrateFS() applies all pending migrations in `migrations`. Like
+// MigrateWithLock() it holds the migration lock while migrating.
+func (e *Environment) MigrateFS(conn *Connection, migrations fs.FS) (*MigrationResult, error) {
+	return e.migrateBy(conn, migrations, func(state *MigrationState) (int, error) {
+		return len(state.Pending), nil
+	})
+}
+
+// MigrateTo() calls Environment.MigrateTo() on the DefaultEnvironment()
+func MigrateTo(conn *Connection, migrations fs.FS, version uint64) (*MigrationResult, error) {
+	env, err := DefaultEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	return env.MigrateTo(conn, migrations, version)
+}
+
+// MigrateTo() applies or rolls back the migrations in `migrations` until the
+// schema is at `version`. Use version 0 to roll back all migrations.
+func (e *Environment) MigrateTo(conn *Connection, migrations fs.FS, version uint64) (*MigrationResult, error) {
+	return e.migrateBy(conn, migrations, func(state *MigrationState) (int, error) {
+		up, down := 0, 0
+		known := version == 0
+		for _, m := range state.Pending {
+			if m.Version <= version {
+				up++
+			}
+			known = known || m.Version == version
+		}
+		for _, m := range state.Applied {
+			if m.Version > version {
+				down++
+			}
+			known = known || m.Version == version
+		}
+		if !known {
+			return 0, fmt.Errorf("Unknown migration version %d", version)
+		}
+		if up > 0 && down > 0 {
+			return 0, fmt.Errorf("Cannot migrate to %d, it requires applying and rolling back migrations", version)
+		}
+		return up - down, nil
+	})
+}
+
+// MigrateDown() calls Environment.MigrateDown() on the DefaultEnvironment()
+func MigrateDown(conn *Connection, migrations fs.FS, steps int) (*MigrationResult, error) {
+	env, err := DefaultEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	return env.MigrateDown(conn, migrations, steps)
+}
+
+// MigrateDown() rolls back the last `steps` migrations in `migrations`
+func (e *Environment) MigrateDown(conn *Connection, migrations fs.FS, steps int) (*MigrationResult, error) {
+	if steps < 0 {
+		return nil, errors.New("Steps should not be negative")
+	}
+	return e.migrateBy(conn, migrations, func(state *MigrationState) (int, error) {
+		if steps > len(state.Applied) {
+			return -len(state.Applied), nil
+		}
+		return -steps, nil
+	})
+}
+
+// migrateBy applies the number of migrations returned by `relative`,
+// rolling back when the number is negative, one at a time. It waits up to
+// DefaultMigrationLockTimeout for the migration lock.
+func (e *Environment) migrateBy(conn *Connection, migrations fs.FS, relative func(state *MigrationState) (int, error)) (*MigrationResult, error) {
+	source, err := openMigrationSource(conn, migrations)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultMigrationLockTimeout)
+	defer cancel()
+	unlock, err := lockMigrations(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	state, err := source.state()
+	if err != nil {
+		return nil, err
+	}
+	n, err := relative(state)
+	if err != nil {
+		return nil, err
+	}
+	result := &MigrationResult{FromVersion: state.Version, ToVersion: state.Version}
+	step, dir, todo := 1, "up", state.Pending
+	if n < 0 {
+		step, dir, todo, n = -1, "down", state.Applied, -n
+	}
+
+	for _, m := range todo[:n] {
+		if step < 0 && !source.reversible[m.Version] {
+			return nil, fmt.Errorf("Migration %d has no down migration", m.Version)
+		}
+	}
+
+	start := time.Now()
+	for _, m := range todo[:n] {
+		stepStart := time.Now()
+		if errs, ok := migrate.MigrateSync(source.url, source.dir, step); !ok {
+			result.Duration = time.Since(start)
+			return result, migrationError(errs)
+		}
+		result.Steps = append(result.Steps, MigrationStep{
+			MigrationInfo: m,
+			Direction:     dir,
+			Duration:      time.Since(stepStart),
+		})
+	}
+	result.Duration = time.Since(start)
+
+	version, err := migrate.Version(source.url, source.dir)
+	if err != nil {
+		return result, fmt.Errorf("Error reading schema version: %s", err.Error())
+	}
+	result.ToVersion = uint64(version)
+	if result.ToVersion != result.FromVersion {
+		if err := e.recordMigration(context.Background(), conn, result.ToVersion); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// migrationSource holds migration files copied to a temporary directory,
+// as the migrate package only reads migrations from disk
+type migrationSource struct {
+	url        string
+	dir        string
+	reversible map[uint64]bool
+}
+
+func openMigrationSource(conn *Connection, migrations fs.FS) (*migrationSource, error) {
+	url, err := migrationURL(conn)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "cfutil-migrations")
+	if err != nil {
+		return nil, err
+	}
+	source := &migrationSource{url: url, dir: dir, reversible: map[uint64]bool{}}
+	entries, err := fs.ReadDir(migrations, ".")
+	if err != nil {
+		source.Close()
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+		data, err := fs.ReadFile(migrations, entry.Name())
+		if err != nil {
+			source.Close()
+			return nil, err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, entry.Name()), data, 0600); err != nil {
+			source.Close()
+			return nil, err
+		}
+	}
+	return source, nil
+}
+
+func (s *migrationSource) Close() error {
+	return os.RemoveAll(s.dir)
+}
+
+func (s *migrationSource) state() (*MigrationState, error) {
+	files, err := file.ReadMigrationFiles(s.dir, file.FilenameRegex("sql"))
+	if err != nil {
+		return nil, err
+	}
+	versions, err := migrate.Versions(s.url, s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading applied migrations: %s", err.Error())
+	}
+	version, err := migrate.Version(s.url, s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading schema version: %s", err.Error())
+	}
+	sort.Sort(files)
+
+	state := &MigrationState{Version: uint64(version)}
+	for _, f := range files {
+		info := MigrationInfo{Version: uint64(f.Version)}
+		if f.UpFile != nil {
+			info.Name = f.UpFile.Name
+		} else if f.DownFile != nil {
+			info.Name = f.DownFile.Name
+		}
+		s.reversible[info.Version] = f.DownFile != nil
+		if versions.Contains(f.Version) {
+			state.Applied = append(state.Applied, info)
+		} else if f.UpFile != nil {
+			state.Pending = append(state.Pending, info)
+		}
+	}
+	// Rollbacks start with the most recent migration
+	for i, j := 0, len(state.Applied)-1; i < j; i, j = i+1, j-1 {
+		state.Applied[i], state.Applied[j] = state.Applied[j], state.Applied[i]
+	}
+	return state, nil
+}
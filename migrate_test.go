@@ -0,0 +1,136 @@
+package cfutil
+
+import (
+	"context"
+	"embed"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/gemnasium/migrate/driver/sqlite3" // SQLite migrations
+)
+
+func testSQLiteConnection(t *testing.T) (*Environment, *Connection) {
+	dir, err := ioutil.TempDir("", "cfutil")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	env, err := NewEnvironmentFromMap(map[string]string{
+		"VCAP_APPLICATION": `{"name":"myapp","instance_id":"abc","instance_index":1}`,
+		"VCAP_SERVICES":    `{"user-provided":[{"name":"db","credentials":{"uri":"sqlite3://` + filepath.Join(dir, "app.db") + `"}}]}`,
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	conn, err := env.NewConnectionWithOptions("sqlite3", "db", ConnectionOptions{})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { conn.Close() })
+	return env, conn
+}
+
+func TestMigrateWithLock(t *testing.T) {
+	env, conn := testSQLiteConnection(t)
+
+	report, err := env.MigrateWithLock(context.Background(), conn, "testdata/migrations")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, report.Migrated)
+	assert.Equal(t, 1, report.InstanceIndex)
+	assert.Equal(t, "abc", report.InstanceID)
+	assert.Equal(t, uint64(0), report.FromVersion)
+	assert.Equal(t, uint64(2), report.ToVersion)
+
+	report, err = env.MigrateWithLock(context.Background(), conn, "testdata/migrations")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, report.Migrated)
+	assert.Equal(t, uint64(2), report.FromVersion)
+
+	// Another instance learns which one migrated
+	other, err := NewEnvironmentFromMap(map[string]string{
+		"VCAP_APPLICATION": `{"name":"myapp","instance_id":"def","instance_index":2}`,
+		"VCAP_SERVICES":    `{}`,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	report, err = other.MigrateWithLock(context.Background(), conn, "testdata/migrations")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, report.Migrated)
+	assert.Equal(t, 1, report.InstanceIndex)
+	assert.Equal(t, "abc", report.InstanceID)
+	assert.False(t, report.MigratedAt.IsZero())
+
+	// Migrations applied by MigrateDown() and others are recorded too
+	migrations, _ := fs.Sub(testMigrations, "testdata/migrations")
+	_, err = other.MigrateDown(conn, migrations, 1)
+	assert.NoError(t, err)
+	report, err = env.MigrateWithLock(context.Background(), conn, "testdata/migrations")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, report.Migrated)
+	assert.Equal(t, uint64(1), report.FromVersion)
+	assert.Equal(t, 1, report.InstanceIndex)
+}
+
+//go:embed testdata/migrations/*.sql
+var testMigrations embed.FS
+
+func TestMigrateFS(t *testing.T) {
+	_, conn := testSQLiteConnection(t)
+	migrations, err := fs.Sub(testMigrations, "testdata/migrations")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	state, err := MigrationStatus(conn, migrations)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, uint64(0), state.Version)
+	assert.Len(t, state.Applied, 0)
+	assert.Equal(t, []MigrationInfo{{1, "create_orders"}, {2, "add_order_status"}}, state.Pending)
+
+	result, err := MigrateTo(conn, migrations, 1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, uint64(1), result.ToVersion)
+	if assert.Len(t, result.Steps, 1) {
+		assert.Equal(t, "up", result.Steps[0].Direction)
+		assert.Equal(t, uint64(1), result.Steps[0].Version)
+	}
+
+	result, err = MigrateFS(conn, os.DirFS("testdata/migrations"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, uint64(1), result.FromVersion)
+	assert.Equal(t, uint64(2), result.ToVersion)
+
+	result, err = MigrateDown(conn, migrations, 5)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, uint64(0), result.ToVersion)
+	if assert.Len(t, result.Steps, 2) {
+		assert.Equal(t, "down", result.Steps[0].Direction)
+		assert.Equal(t, uint64(2), result.Steps[0].Version)
+		assert.Equal(t, uint64(1), result.Steps[1].Version)
+	}
+
+	_, err = MigrateTo(conn, migrations, 3)
+	assert.Error(t, err)
+}
@@ -0,0 +1,553 @@
+package cfutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/streadway/amqp"
+)
+
+// DefaultOutboxTable is the table used by an Outbox when OutboxConfig.Table is empty
+const DefaultOutboxTable = "cfutil_outbox"
+
+var (
+	outboxTableRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+	indexNameRegex   = regexp.MustCompile(`[^A-Za-z0-9_]`)
+)
+
+// outboxSchemas hold the DDL of the outbox table per driver, `%[1]s` is the table name
+var outboxSchemas = map[string]string{
+	"postgres": `CREATE TABLE IF NOT EXISTS %[1]s (
+	id BIGSERIAL PRIMARY KEY,
+	exchange TEXT NOT NULL,
+	routing_key TEXT NOT NULL,
+	properties TEXT NOT NULL,
+	body BYTEA NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	sent_at TIMESTAMP WITH TIME ZONE,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT,
+	failed_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS %[2]s_pending ON %[1]s (id) WHERE sent_at IS NULL AND failed_at IS NULL;
+`,
+	"mysql": `CREATE TABLE IF NOT EXISTS %[1]s (
+	id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+	exchange VARCHAR(255) NOT NULL,
+	routing_key VARCHAR(255) NOT NULL,
+	properties TEXT NOT NULL,
+	body LONGBLOB NOT NULL,
+	created_at TIMESTAMP(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+	sent_at TIMESTAMP(6) NULL,
+	attempts INT NOT NULL DEFAULT 0,
+	last_error TEXT,
+	failed_at TIMESTAMP(6) NULL,
+	INDEX %[2]s_pending (sent_at, failed_at, id)
+);
+`,
+	"sqlite3": `CREATE TABLE IF NOT EXISTS %[1]s (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	exchange TEXT NOT NULL,
+	routing_key TEXT NOT NULL,
+	properties TEXT NOT NULL,
+	body BLOB NOT NULL,
+	created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	sent_at DATETIME,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT,
+	failed_at DATETIME
+);
+CREATE INDEX IF NOT EXISTS %[2]s_pending ON %[1]s (sent_at, failed_at, id);
+`,
+}
+
+// OutboxConfig configures an Outbox
+type OutboxConfig struct {
+	// Table is the name of the outbox table, DefaultOutboxTable when empty
+	Table string
+	// BatchSize is the maximum number of messages relayed per transaction, default 100
+	BatchSize int
+	// PollInterval is the time Run() waits when there is nothing to relay, default 1s
+	PollInterval time.Duration
+	// PublishTimeout limits the wait for each publisher confirm, default 10s
+	PublishTimeout time.Duration
+	// BatchTimeout limits the time the rows of a batch stay locked, default 30s.
+	// Messages not published by then are left for the next batch.
+	BatchTimeout time.Duration
+	// MaxAttempts is the number of times a message is tried before it is marked
+	// failed and skipped, so it does not hold up the messages after it, default 10.
+	// Only nacks, returns, confirm timeouts, channel exceptions and messages that
+	// cannot be decoded count, not failing to reach RabbitMQ.
+	MaxAttempts int
+	// Logger receives diagnostics, DefaultLogger when nil
+	Logger Logger
+}
+
+// Outbox implements the transactional outbox pattern: messages are written to
+// a table in the same transaction as the business data and relayed to
+// RabbitMQ afterwards. Messages are delivered at least once. A single relay
+// keeps their order, except for messages that failed MaxAttempts times,
+// concurrent relays each work on their own batch.
+type Outbox struct {
+	conn     *Connection
+	producer *Producer
+	config   OutboxConfig
+	log      Logger
+}
+
+// outboxProperties are the message properties stored as JSON
+type outboxProperties struct {
+	Headers         map[string]outboxValue `json:"headers,omitempty"`
+	ContentType     string                 `json:"content_type,omitempty"`
+	ContentEncoding string                 `json:"content_encoding,omitempty"`
+	DeliveryMode    uint8                  `json:"delivery_mode,omitempty"`
+	Priority        uint8                  `json:"priority,omitempty"`
+	CorrelationId   string                 `json:"correlation_id,omitempty"`
+	ReplyTo         string                 `json:"reply_to,omitempty"`
+	Expiration      string                 `json:"expiration,omitempty"`
+	MessageId       string                 `json:"message_id,omitempty"`
+	Timestamp       time.Time              `json:"timestamp,omitempty"`
+	Type            string                 `json:"type,omitempty"`
+	AppId           string                 `json:"app_id,omitempty"`
+}
+
+// outboxValue is a header value with its AMQP type
+type outboxValue struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+type outboxRow struct {
+	ID         int64  `db:"id"`
+	Exchange   string `db:"exchange"`
+	RoutingKey string `db:"routing_key"`
+	Properties string `db:"properties"`
+	Body       []byte `db:"body"`
+	Attempts   int    `db:"attempts"`
+}
+
+// NewOutbox() returns an Outbox storing messages in the database of `conn`
+// and relaying them with `producer`. The producer may be nil for instances
+// that only enqueue messages.
+func NewOutbox(conn *Connection, producer *Producer, config OutboxConfig) (*Outbox, error) {
+	if config.Table == "" {
+		config.Table = DefaultOutboxTable
+	}
+	if !outboxTableRegex.MatchString(config.Table) {
+		return nil, fmt.Errorf("Invalid outbox table name '%s'", config.Table)
+	}
+	if _, ok := outboxSchemas[conn.DriverName()]; !ok {
+		return nil, fmt.Errorf("Unsupported driver '%s'", conn.DriverName())
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 100
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = time.Second
+	}
+	if config.PublishTimeout <= 0 {
+		config.PublishTimeout = 10 * time.Second
+	}
+	if config.BatchTimeout <= 0 {
+		config.BatchTimeout = 30 * time.Second
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 10
+	}
+	o := &Outbox{
+		conn:     conn,
+		producer: producer,
+		config:   config,
+		log:      config.Logger,
+	}
+	if o.log == nil {
+		o.log = defaultLogger
+	}
+	return o, nil
+}
+
+// OutboxSchema() returns the DDL creating the outbox table `table` for
+// `driver`, for inclusion in the migrations of the app
+func OutboxSchema(driver, table string) (string, error) {
+	schema, ok := outboxSchemas[driver]
+	if !ok {
+		return "", fmt.Errorf("Unsupported driver '%s'", driver)
+	}
+	if table == "" {
+		table = DefaultOutboxTable
+	}
+	if !outboxTableRegex.MatchString(table) {
+		return "", fmt.Errorf("Invalid outbox table name '%s'", table)
+	}
+	return fmt.Sprintf(schema, table, indexName(table)), nil
+}
+
+// CreateTable() creates the outbox table when it does not exist yet
+func (o *Outbox) CreateTable(ctx context.Context) error {
+	schema, err := OutboxSchema(o.conn.DriverName(), o.config.Table)
+	if err != nil {
+		return err
+	}
+	// Not all drivers accept several statements at once
+	for _, statement := range bytes.Split([]byte(schema), []byte(";\n")) {
+		if len(bytes.TrimSpace(statement)) == 0 {
+			continue
+		}
+		if _, err := o.conn.ExecContext(ctx, string(statement)); err != nil {
+			return fmt.Errorf("Error creating outbox table: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// Enqueue() stores `msg` in the outbox as part of `tx`. It is published once
+// the transaction commits and a relay picks it up. The correlation ID and
+// trace context of `ctx` are added to the headers like Producer.Publish() does.
+func (o *Outbox) Enqueue(ctx context.Context, tx *sqlx.Tx, exchange, routingKey string, msg amqp.Publishing) error {
+	msg = injectTraceHeaders(ctx, msg)
+	headers, err := encodeHeaders(msg.Headers)
+	if err != nil {
+		return fmt.Errorf("Error encoding message properties: %s", err.Error())
+	}
+	properties, err := json.Marshal(outboxProperties{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		AppId:           msg.AppId,
+	})
+	if err != nil {
+		return fmt.Errorf("Error encoding message properties: %s", err.Error())
+	}
+	body := msg.Body
+	if body == nil {
+		body = []byte{}
+	}
+	query := tx.Rebind("INSERT INTO " + o.config.Table + " (exchange, routing_key, properties, body) VALUES (?, ?, ?, ?)")
+	if _, err := tx.ExecContext(ctx, query, exchange, routingKey, string(properties), body); err != nil {
+		return fmt.Errorf("Error enqueueing message: %s", err.Error())
+	}
+	return nil
+}
+
+// Run() relays messages until `ctx` is done. It is safe to run it on every
+// instance of an app: on Postgres and MySQL rows are locked with SKIP LOCKED
+// so each message is picked up by one relay only.
+func (o *Outbox) Run(ctx context.Context) error {
+	for {
+		n, err := o.Relay(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			o.log.Warning(ctx, "Outbox relay failed: %v", err)
+			o.waitForProducer(ctx)
+		}
+		if n == o.config.BatchSize && err == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(o.config.PollInterval):
+		}
+	}
+}
+
+// waitForProducer backs off until the Producer is connected again
+func (o *Outbox) waitForProducer(ctx context.Context) {
+	for attempt := 0; o.producer.State() != StateConnected; attempt++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(o.producer.config.Backoff.Delay(attempt)):
+		}
+	}
+}
+
+// Relay() publishes one batch of pending messages with publisher confirms and
+// marks them sent. It stops at the first message that fails, so the order of
+// messages is kept, and returns the number of messages relayed. A message that
+// failed MaxAttempts times gets `failed_at` set instead and is skipped from
+// then on. When RabbitMQ cannot be reached the message is left untouched.
+// Publishing stops when BatchTimeout expires.
+func (o *Outbox) Relay(ctx context.Context) (int, error) {
+	if o.producer == nil {
+		return 0, errors.New("Outbox has no producer")
+	}
+	tx, err := o.conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := "SELECT id, exchange, routing_key, properties, body, attempts FROM " + o.config.Table +
+		" WHERE sent_at IS NULL AND failed_at IS NULL ORDER BY id LIMIT ?"
+	switch o.conn.DriverName() {
+	case "postgres", "mysql":
+		query += " FOR UPDATE SKIP LOCKED"
+	}
+	var rows []outboxRow
+	if err := tx.SelectContext(ctx, &rows, tx.Rebind(query), o.config.BatchSize); err != nil {
+		return 0, fmt.Errorf("Error reading outbox: %s", err.Error())
+	}
+
+	// The rows stay locked until the transaction commits
+	batchCtx, cancel := context.WithTimeout(ctx, o.config.BatchTimeout)
+	defer cancel()
+	sent := 0
+	var publishErr error
+	for _, row := range rows {
+		if batchCtx.Err() != nil {
+			break
+		}
+		msg, err := row.publishing()
+		if err == nil {
+			publishCtx, cancel := context.WithTimeout(batchCtx, o.config.PublishTimeout)
+			err = o.producer.PublishConfirmed(publishCtx, row.Exchange, row.RoutingKey, msg)
+			cancel()
+			if err != nil && !isMessageError(err) {
+				// Not the fault of the message, it is tried again once reconnected
+				publishErr = err
+				break
+			}
+		}
+		if err != nil && batchCtx.Err() != nil {
+			// Out of time, the message is tried again in the next batch
+			break
+		}
+		if err != nil && row.Attempts+1 >= o.config.MaxAttempts {
+			o.log.Error(ctx, "Outbox message %d failed %d times, giving up: %v", row.ID, row.Attempts+1, err)
+			update := tx.Rebind("UPDATE " + o.config.Table + " SET failed_at = CURRENT_TIMESTAMP, attempts = attempts + 1, last_error = ? WHERE id = ?")
+			if _, err := tx.ExecContext(ctx, update, err.Error(), row.ID); err != nil {
+				return sent, err
+			}
+			continue
+		}
+		if err != nil {
+			publishErr = err
+			update := tx.Rebind("UPDATE " + o.config.Table + " SET attempts = attempts + 1, last_error = ? WHERE id = ?")
+			if _, err := tx.ExecContext(ctx, update, err.Error(), row.ID); err != nil {
+				return sent, err
+			}
+			break
+		}
+		update := tx.Rebind("UPDATE " + o.config.Table + " SET sent_at = CURRENT_TIMESTAMP, attempts = attempts + 1 WHERE id = ?")
+		if _, err := tx.ExecContext(ctx, update, row.ID); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if publishErr != nil {
+		return sent, fmt.Errorf("Error publishing outbox message: %s", publishErr.Error())
+	}
+	return sent, nil
+}
+
+// isMessageError returns true when the broker refused the message itself,
+// as opposed to errors connecting to it
+func isMessageError(err error) bool {
+	var publishErr *PublishError
+	var exception *amqp.Error
+	return errors.As(err, &publishErr) || errors.As(err, &exception) && exception.Recover
+}
+
+// Purge() deletes messages that were sent before `before`
+func (o *Outbox) Purge(ctx context.Context, before time.Time) (int64, error) {
+	query := o.conn.Rebind("DELETE FROM " + o.config.Table + " WHERE sent_at IS NOT NULL AND sent_at < ?")
+	result, err := o.conn.ExecContext(ctx, query, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (r outboxRow) publishing() (amqp.Publishing, error) {
+	var p outboxProperties
+	if err := json.Unmarshal([]byte(r.Properties), &p); err != nil {
+		return amqp.Publishing{}, fmt.Errorf("Error decoding message properties: %s", err.Error())
+	}
+	headers, err := decodeHeaders(p.Headers)
+	if err != nil {
+		return amqp.Publishing{}, fmt.Errorf("Error decoding message properties: %s", err.Error())
+	}
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     p.ContentType,
+		ContentEncoding: p.ContentEncoding,
+		DeliveryMode:    p.DeliveryMode,
+		Priority:        p.Priority,
+		CorrelationId:   p.CorrelationId,
+		ReplyTo:         p.ReplyTo,
+		Expiration:      p.Expiration,
+		MessageId:       p.MessageId,
+		Timestamp:       p.Timestamp,
+		Type:            p.Type,
+		AppId:           p.AppId,
+		Body:            r.Body,
+	}, nil
+}
+
+// encodeHeaders stores the AMQP type of each header value next to it, so
+// values like []byte, time.Time and int16 survive the JSON round trip
+func encodeHeaders(t amqp.Table) (map[string]outboxValue, error) {
+	if t == nil {
+		return nil, nil
+	}
+	encoded := make(map[string]outboxValue, len(t))
+	for k, v := range t {
+		value, err := encodeHeaderValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("header %q: %s", k, err)
+		}
+		encoded[k] = value
+	}
+	return encoded, nil
+}
+
+func encodeHeaderValue(value interface{}) (outboxValue, error) {
+	var kind string
+	switch v := value.(type) {
+	case nil:
+		return outboxValue{Type: "nil"}, nil
+	case bool:
+		kind = "bool"
+	case byte:
+		kind = "byte"
+	case int16:
+		kind = "int16"
+	case int32:
+		kind = "int32"
+	case int64:
+		kind = "int64"
+	case float32:
+		kind = "float32"
+	case float64:
+		kind = "float64"
+	case string:
+		kind = "string"
+	case []byte:
+		kind = "bytes"
+	case amqp.Decimal:
+		kind = "decimal"
+	case time.Time:
+		kind = "time"
+	case amqp.Table:
+		t, err := encodeHeaders(v)
+		if err != nil {
+			return outboxValue{}, err
+		}
+		kind, value = "table", t
+	case []interface{}:
+		a := make([]outboxValue, len(v))
+		for i := range v {
+			item, err := encodeHeaderValue(v[i])
+			if err != nil {
+				return outboxValue{}, err
+			}
+			a[i] = item
+		}
+		kind, value = "array", a
+	default:
+		return outboxValue{}, fmt.Errorf("type %T is not supported by AMQP", value)
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return outboxValue{}, err
+	}
+	return outboxValue{Type: kind, Value: raw}, nil
+}
+
+// decodeHeaders reverses encodeHeaders()
+func decodeHeaders(encoded map[string]outboxValue) (amqp.Table, error) {
+	if encoded == nil {
+		return nil, nil
+	}
+	t := make(amqp.Table, len(encoded))
+	for k, v := range encoded {
+		value, err := decodeHeaderValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("header %q: %s", k, err)
+		}
+		t[k] = value
+	}
+	return t, nil
+}
+
+func decodeHeaderValue(v outboxValue) (interface{}, error) {
+	var target interface{}
+	switch v.Type {
+	case "nil":
+		return nil, nil
+	case "bool":
+		target = new(bool)
+	case "byte":
+		target = new(byte)
+	case "int16":
+		target = new(int16)
+	case "int32":
+		target = new(int32)
+	case "int64":
+		target = new(int64)
+	case "float32":
+		target = new(float32)
+	case "float64":
+		target = new(float64)
+	case "string":
+		target = new(string)
+	case "bytes":
+		target = new([]byte)
+	case "decimal":
+		target = new(amqp.Decimal)
+	case "time":
+		target = new(time.Time)
+	case "table":
+		var t map[string]outboxValue
+		if err := json.Unmarshal(v.Value, &t); err != nil {
+			return nil, err
+		}
+		return decodeHeaders(t)
+	case "array":
+		var items []outboxValue
+		if err := json.Unmarshal(v.Value, &items); err != nil {
+			return nil, err
+		}
+		a := make([]interface{}, len(items))
+		for i := range items {
+			item, err := decodeHeaderValue(items[i])
+			if err != nil {
+				return nil, err
+			}
+			a[i] = item
+		}
+		return a, nil
+	default:
+		return nil, fmt.Errorf("unknown type '%s'", v.Type)
+	}
+	if err := json.Unmarshal(v.Value, target); err != nil {
+		return nil, err
+	}
+	return reflect.ValueOf(target).Elem().Interface(), nil
+}
+
+// indexName returns a name for the index of `table`, which may be schema qualified
+func indexName(table string) string {
+	return indexNameRegex.ReplaceAllString(table, "_")
+}
@@ -0,0 +1,163 @@
+package cfutil_test
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/loafoe/cfutil"
+	"github.com/loafoe/cfutil/cfutiltest"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cfutil")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	broker := cfutiltest.NewBroker()
+	env, err := cfutil.NewEnvironmentFromMap(map[string]string{
+		"VCAP_APPLICATION": `{"name":"myapp"}`,
+		"VCAP_SERVICES": `{"user-provided":[` +
+			`{"name":"db","credentials":{"uri":"sqlite3://` + filepath.Join(dir, "app.db") + `"}},` +
+			`{"name":"rabbitmq","credentials":{"uri":"` + cfutiltest.BrokerURI + `"}}]}`,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn, err := env.NewConnectionWithOptions("sqlite3", "db", cfutil.ConnectionOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	producer, err := env.NewProducer(cfutil.ProducerConfig{
+		ServiceName:  "rabbitmq",
+		Exchange:     "orders",
+		ExchangeType: amqp.ExchangeTopic,
+		Dialer:       broker.Dial,
+		Backoff:      cfutil.Backoff{Initial: time.Millisecond, Max: 10 * time.Millisecond},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer producer.Close()
+
+	outbox, err := cfutil.NewOutbox(conn, producer, cfutil.OutboxConfig{BatchSize: 10, MaxAttempts: 2})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx := context.WithValue(context.Background(), cfutil.KeyCorrelationID, "abc")
+	assert.NoError(t, outbox.CreateTable(ctx))
+	assert.NoError(t, outbox.CreateTable(ctx))
+
+	// Header values AMQP cannot carry are rejected
+	tx := conn.MustBegin()
+	assert.Error(t, outbox.Enqueue(ctx, tx, "orders", "order.created", amqp.Publishing{Headers: amqp.Table{"size": uint64(1)}}))
+	assert.NoError(t, tx.Rollback())
+
+	// A rolled back transaction leaves nothing to publish
+	tx = conn.MustBegin()
+	assert.NoError(t, outbox.Enqueue(ctx, tx, "orders", "order.created", amqp.Publishing{Body: []byte("rolled back")}))
+	assert.NoError(t, tx.Rollback())
+
+	tx = conn.MustBegin()
+	assert.NoError(t, outbox.Enqueue(ctx, tx, "orders", "order.created", amqp.Publishing{
+		Body: []byte("1"),
+		Headers: amqp.Table{
+			"version": int64(2),
+			"retries": int16(3),
+			"raw":     []byte("x"),
+			"at":      time.Unix(1500000000, 0).UTC(),
+			"nested":  amqp.Table{"ids": []interface{}{int32(1), "two"}},
+		},
+	}))
+	assert.NoError(t, outbox.Enqueue(ctx, tx, "orders", "order.unroutable", amqp.Publishing{Body: []byte("2")}))
+	assert.NoError(t, outbox.Enqueue(ctx, tx, "orders", "order.created", amqp.Publishing{Body: []byte("3")}))
+	assert.NoError(t, tx.Commit())
+
+	conn2, _ := broker.Dial(broker.URI(), nil)
+	ch, _ := conn2.Channel()
+	ch.QueueDeclare("orders.created", true, false, false, false, nil)
+	ch.QueueBind("orders.created", "order.created", "orders", false, nil)
+
+	// The unroutable message is returned and holds up the message after it
+	n, err := outbox.Relay(ctx)
+	assert.Error(t, err)
+	assert.Equal(t, 1, n)
+	messages := broker.Messages("orders.created")
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "abc", messages[0].Headers[cfutil.CorrelationIDHeader])
+		assert.Equal(t, int64(2), messages[0].Headers["version"])
+		assert.Equal(t, int16(3), messages[0].Headers["retries"])
+		assert.Equal(t, []byte("x"), messages[0].Headers["raw"])
+		assert.Equal(t, time.Unix(1500000000, 0).UTC(), messages[0].Headers["at"])
+		assert.Equal(t, amqp.Table{"ids": []interface{}{int32(1), "two"}}, messages[0].Headers["nested"])
+	}
+
+	// After MaxAttempts it is marked failed and skipped
+	n, err = outbox.Relay(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	var failed struct {
+		Attempts  int    `db:"attempts"`
+		LastError string `db:"last_error"`
+	}
+	assert.NoError(t, conn.Get(&failed, "SELECT attempts, last_error FROM cfutil_outbox WHERE failed_at IS NOT NULL"))
+	assert.Equal(t, 2, failed.Attempts)
+	assert.NotEmpty(t, failed.LastError)
+
+	ch.QueueBind("orders.created", "order.*", "orders", false, nil)
+	n, err = outbox.Relay(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	if messages := broker.Messages("orders.created"); assert.Len(t, messages, 2) {
+		assert.Equal(t, "3", string(messages[1].Body))
+	}
+
+	// Failing to reach RabbitMQ does not count as an attempt
+	tx = conn.MustBegin()
+	assert.NoError(t, outbox.Enqueue(ctx, tx, "orders", "order.created", amqp.Publishing{Body: []byte("4")}))
+	assert.NoError(t, tx.Commit())
+	broker.SetUnavailable(true)
+	broker.Disconnect()
+	waitForState(producer, cfutil.StateReconnecting)
+	for i := 0; i < 3; i++ {
+		n, err = outbox.Relay(ctx)
+		assert.Error(t, err)
+		assert.Equal(t, 0, n)
+	}
+	var pending struct {
+		Attempts int            `db:"attempts"`
+		FailedAt sql.NullString `db:"failed_at"`
+	}
+	assert.NoError(t, conn.Get(&pending, "SELECT attempts, failed_at FROM cfutil_outbox WHERE sent_at IS NULL AND last_error IS NULL"))
+	assert.Equal(t, 0, pending.Attempts)
+	assert.False(t, pending.FailedAt.Valid)
+	broker.SetUnavailable(false)
+	waitForState(producer, cfutil.StateConnected)
+	n, err = outbox.Relay(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	purged, err := outbox.Purge(ctx, time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), purged)
+
+	schema, err := cfutil.OutboxSchema("postgres", "events.outbox")
+	assert.NoError(t, err)
+	assert.Contains(t, schema, "CREATE INDEX IF NOT EXISTS events_outbox_pending ON events.outbox")
+	_, err = cfutil.OutboxSchema("postgres", "outbox; DROP TABLE users")
+	assert.Error(t, err)
+}
+
+func waitForState(producer *cfutil.Producer, state cfutil.ConnectionState) {
+	for i := 0; i < 100 && producer.State() != state; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -9,24 +9,34 @@ import (
 )
 
 type PHService struct {
-	Type            string `json:"type"`
-	ApplicationName string `json:"application_name"`
-	PropositionName string `json:"proposition_name"`
-	BaseURL         string `json:"base_url"`
-	SharedKey       string `json:"shared_key"`
-	SharedSecret    string `json:"shared_secret"`
-	Client          string `json:"client"`
-	Password        string `json:"password"`
+	Type            string `json:"type" mapstructure:"-"`
+	ApplicationName string `json:"application_name" mapstructure:"application_name"`
+	PropositionName string `json:"proposition_name" mapstructure:"proposition_name"`
+	BaseURL         string `json:"base_url" mapstructure:"-"`
+	SharedKey       string `json:"shared_key" mapstructure:"shared_key"`
+	SharedSecret    string `json:"shared_secret" mapstructure:"shared_secret"`
+	Client          string `json:"client" mapstructure:"-"`
+	Password        string `json:"password" mapstructure:"-"`
 }
 
+// ConnectPHService() calls Environment.ConnectPHService() on the DefaultEnvironment()
 func ConnectPHService(phServiceType, serviceName string) (*PHService, error) {
+	env, err := DefaultEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	return env.ConnectPHService(phServiceType, serviceName)
+}
+
+// ConnectPHService() returns the PH service named `serviceName` or the
+// first service with a URI starting with `phServiceType`
+func (e *Environment) ConnectPHService(phServiceType, serviceName string) (*PHService, error) {
 	var phService PHService
-	appEnv, _ := Current()
 	var service *cfenv.Service
 	var err error
-	service, err = appEnv.Services.WithName(serviceName)
+	service, err = e.serviceByName(serviceName)
 	if err != nil {
-		service, err = firstMatchingServiceURN(appEnv, phServiceType+":")
+		service, err = e.firstMatchingServiceURN(phServiceType + ":")
 		if err != nil {
 			return nil, err
 		}
@@ -41,19 +51,10 @@ func ConnectPHService(phServiceType, serviceName string) (*PHService, error) {
 	if !strings.HasPrefix(str, phServiceType+":") {
 		return nil, fmt.Errorf("PH service mismatch: %s --> %s", phServiceType, str)
 	}
-	phService.BaseURL = strings.TrimPrefix(str, phServiceType+":")
-	if val, ok := service.Credentials["application_name"].(string); ok {
-		phService.ApplicationName = val
-	}
-	if val, ok := service.Credentials["proposition_name"].(string); ok {
-		phService.PropositionName = val
-	}
-	if val, ok := service.Credentials["shared_key"].(string); ok {
-		phService.SharedKey = val
-	}
-	if val, ok := service.Credentials["shared_secret"].(string); ok {
-		phService.SharedSecret = val
+	if err := DecodeCredentials(service, &phService); err != nil {
+		return nil, err
 	}
+	phService.BaseURL = strings.TrimPrefix(str, phServiceType+":")
 	phService.Type = phServiceType
 	return &phService, nil
 }
@@ -0,0 +1,45 @@
+// Package protobuf provides a cfutil.Codec for protobuf messages. It is a
+// module of its own so cfutil does not depend on the protobuf runtime.
+package protobuf
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/loafoe/cfutil"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec encodes protobuf messages as `application/x-protobuf`
+var Codec cfutil.Codec = codec{}
+
+type codec struct{}
+
+func (codec) ContentType() string     { return "application/x-protobuf" }
+func (codec) ContentEncoding() string { return "" }
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a protobuf message", v)
+	}
+	return proto.Marshal(m)
+}
+
+// Unmarshal() accepts a protobuf message or a pointer to one, which is
+// allocated when nil, as generic handlers pass a pointer to their message
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr && rv.Elem().Kind() == reflect.Ptr {
+		if rv.Elem().IsNil() {
+			rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+		}
+		if m, ok := rv.Elem().Interface().(proto.Message); ok {
+			return proto.Unmarshal(data, m)
+		}
+	}
+	return fmt.Errorf("%T is not a protobuf message", v)
+}
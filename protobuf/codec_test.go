@@ -0,0 +1,28 @@
+package protobuf_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/loafoe/cfutil"
+	"github.com/loafoe/cfutil/protobuf"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestCodec(t *testing.T) {
+	msg, err := cfutil.EncodeMessage(protobuf.Codec, wrapperspb.String("hello"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "application/x-protobuf", msg.ContentType)
+		var received string
+		handler := cfutil.HandleCodec(protobuf.Codec, func(ctx context.Context, s *wrapperspb.StringValue) error {
+			received = s.GetValue()
+			return nil
+		})
+		assert.NoError(t, handler(context.Background(), amqp.Delivery{ContentType: msg.ContentType, Body: msg.Body}))
+		assert.Equal(t, "hello", received)
+	}
+	_, err = cfutil.EncodeMessage(protobuf.Codec, struct{ ID string }{"42"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,49 @@
+module github.com/loafoe/cfutil/protobuf
+
+go 1.18
+
+require (
+	github.com/loafoe/cfutil v0.0.0-20261018041948-5dd222a30855
+	github.com/streadway/amqp v0.0.0-20180315184602-8e4aba63da9f
+	github.com/stretchr/testify v1.2.2
+	google.golang.org/protobuf v1.27.1
+)
+
+require (
+	github.com/cloudfoundry-community/go-cfenv v1.17.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/gemnasium/migrate v1.4.1 // indirect
+	github.com/go-sql-driver/mysql v1.4.0 // indirect
+	github.com/golang/snappy v0.0.0-20170215233205-553a64147049 // indirect
+	github.com/google/uuid v1.1.1 // indirect
+	github.com/hailocab/go-hostpool v0.0.0-20160125115350-e80d13ce29ed // indirect
+	github.com/hashicorp/consul v1.2.2 // indirect
+	github.com/hashicorp/errwrap v1.0.0 // indirect
+	github.com/hashicorp/go-cleanhttp v0.0.0-20171218145408-d5fe4b57a186 // indirect
+	github.com/hashicorp/go-multierror v1.0.0 // indirect
+	github.com/hashicorp/go-retryablehttp v0.0.0-20180718195005-e651d75abec6 // indirect
+	github.com/hashicorp/go-rootcerts v0.0.0-20160503143440-6bb64b370b90 // indirect
+	github.com/hashicorp/go-sockaddr v0.0.0-20180320115054-6d291a969b86 // indirect
+	github.com/hashicorp/hcl v0.0.0-20180404174102-ef8a98b0bbce // indirect
+	github.com/hashicorp/serf v0.8.1 // indirect
+	github.com/hashicorp/vault v0.11.1 // indirect
+	github.com/jeffail/gabs v1.0.0 // indirect
+	github.com/jmoiron/sqlx v0.0.0-20180406164412-2aeb6a910c2b // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
+	github.com/lib/pq v0.0.0-20180327071824-d34b9ff171c2 // indirect
+	github.com/mitchellh/go-homedir v1.0.0 // indirect
+	github.com/mitchellh/mapstructure v0.0.0-20180220230111-00c29f56e238 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/ryanuber/go-glob v0.0.0-20160226084822-572520ed46db // indirect
+	github.com/sirupsen/logrus v1.4.1 // indirect
+	golang.org/x/net v0.0.0-20180826012351-8a410e7b638d // indirect
+	golang.org/x/sys v0.0.0-20190507160741-ecd444e8653b // indirect
+	golang.org/x/text v0.3.0 // indirect
+	golang.org/x/time v0.0.0-20180412165947-fbb02b2291d2 // indirect
+	google.golang.org/appengine v1.1.0 // indirect
+	gopkg.in/inf.v0 v0.9.1 // indirect
+	gopkg.in/yaml.v2 v2.2.1 // indirect
+)
+
+// Builds against the cfutil of this repository, dependents use the version required above
+replace github.com/loafoe/cfutil => ../
@@ -0,0 +1,149 @@
+package cfutil
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	cfenv "github.com/cloudfoundry-community/go-cfenv"
+)
+
+// Query selects bound services. Empty fields match any service,
+// all comparisons are case insensitive.
+type Query struct {
+	Label     string // service label, e.g. `hsdp-rdb`
+	Plan      string // service plan
+	Tag       string // one of the service tags
+	Name      string // service instance name
+	URIScheme string // scheme of the `uri` credential, e.g. `postgres` or `sentry`
+}
+
+func (q Query) String() string {
+	var parts []string
+	for _, p := range []struct{ key, value string }{
+		{"label", q.Label},
+		{"plan", q.Plan},
+		{"tag", q.Tag},
+		{"name", q.Name},
+		{"scheme", q.URIScheme},
+	} {
+		if p.value != "" {
+			parts = append(parts, p.key+"="+p.value)
+		}
+	}
+	if len(parts) == 0 {
+		return "any"
+	}
+	return strings.Join(parts, ",")
+}
+
+// Matches() returns true if `service` satisfies the query
+func (q Query) Matches(service *cfenv.Service) bool {
+	if q.Label != "" && !strings.EqualFold(q.Label, service.Label) {
+		return false
+	}
+	if q.Plan != "" && !strings.EqualFold(q.Plan, service.Plan) {
+		return false
+	}
+	if q.Name != "" && !strings.EqualFold(q.Name, service.Name) {
+		return false
+	}
+	if q.Tag != "" {
+		found := false
+		for _, tag := range service.Tags {
+			if strings.EqualFold(q.Tag, tag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q.URIScheme != "" {
+		uri, ok := service.Credentials["uri"].(string)
+		if !ok || !strings.HasPrefix(strings.ToLower(uri), strings.ToLower(q.URIScheme)+":") {
+			return false
+		}
+	}
+	return true
+}
+
+// FindServices() returns all services in the DefaultEnvironment() matching `query`
+func FindServices(query Query) ([]cfenv.Service, error) {
+	env, err := DefaultEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	return env.FindServices(query)
+}
+
+// MustFindOne() returns the single service in the DefaultEnvironment() matching `query`
+func MustFindOne(query Query) (*cfenv.Service, error) {
+	env, err := DefaultEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	return env.MustFindOne(query)
+}
+
+// FindServices() returns all services matching `query`. Services are ordered
+// by label and keep the order in which they appear in VCAP_SERVICES within
+// a label, so the result is the same on every call. It fails when the credential
+// references of a matching service cannot be resolved, see WithCredentialResolver().
+func (e *Environment) FindServices(query Query) ([]cfenv.Service, error) {
+	var result []cfenv.Service
+	for _, service := range e.orderedServices() {
+		if query.Matches(&service) {
+			result = append(result, service)
+		}
+	}
+	if len(result) == 0 && query.URIScheme != "" {
+		// The `uri` of a service that is not resolved cannot match
+		return nil, e.credentialError()
+	}
+	if err := e.credentialError(result...); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// MustFindOne() returns the service matching `query`. It returns an error
+// when no service or more than one service matches.
+func (e *Environment) MustFindOne(query Query) (*cfenv.Service, error) {
+	services, err := e.FindServices(query)
+	if err != nil {
+		return nil, err
+	}
+	switch len(services) {
+	case 0:
+		return nil, fmt.Errorf("No service found matching %s", query)
+	case 1:
+		return &services[0], nil
+	}
+	names := make([]string, len(services))
+	for i, service := range services {
+		names[i] = service.Name
+	}
+	return nil, fmt.Errorf("Multiple services found matching %s: %s", query, strings.Join(names, ", "))
+}
+
+func (e *Environment) orderedServices() []cfenv.Service {
+	all := e.services()
+	labels := make([]string, 0, len(all))
+	for label := range all {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	var services []cfenv.Service
+	for _, label := range labels {
+		for _, service := range all[label] {
+			if service.Label == "" {
+				service.Label = label
+			}
+			services = append(services, service)
+		}
+	}
+	return services
+}
@@ -0,0 +1,51 @@
+package cfutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindServices(t *testing.T) {
+	env, err := NewEnvironmentFromMap(map[string]string{
+		"VCAP_APPLICATION": `{"name":"myapp"}`,
+		"VCAP_SERVICES": `{
+			"hsdp-rdb": [
+				{"name": "orders-db", "plan": "postgres-micro-dev", "tags": ["postgres"], "credentials": {"uri": "postgres://orders"}},
+				{"name": "audit-db", "plan": "postgres-medium-prod", "tags": ["postgres"], "credentials": {"uri": "postgres://audit"}}
+			],
+			"user-provided": [
+				{"name": "sentry", "credentials": {"uri": "sentry:https://foo@sentry.io/1"}}
+			]
+		}`,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	for i := 0; i < 10; i++ {
+		services, err := env.FindServices(Query{URIScheme: "postgres"})
+		assert.NoError(t, err)
+		if assert.Len(t, services, 2) {
+			assert.Equal(t, "orders-db", services[0].Name)
+			assert.Equal(t, "audit-db", services[1].Name)
+		}
+	}
+
+	service, err := env.MustFindOne(Query{Label: "hsdp-rdb", Plan: "postgres-medium-prod"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "audit-db", service.Name)
+	}
+	service, err = env.MustFindOne(Query{URIScheme: "sentry"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "sentry", service.Name)
+	}
+
+	_, err = env.MustFindOne(Query{Tag: "postgres"})
+	assert.Error(t, err)
+	_, err = env.MustFindOne(Query{Label: "hsdp-redis"})
+	assert.Error(t, err)
+
+	_, _, err = env.NewConnection("postgres", "")
+	assert.Error(t, err)
+}
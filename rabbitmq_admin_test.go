@@ -0,0 +1,86 @@
+package cfutil_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/loafoe/cfutil"
+	"github.com/loafoe/cfutil/cfutiltest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRabbitMQAdmin(t *testing.T) {
+	server := cfutiltest.NewRabbitMQAdminServer()
+	defer server.Close()
+	server.SetQueue(cfutil.QueueInfo{Name: "orders", Durable: true, MessagesReady: 5, MessagesUnacknowledged: 2, Consumers: 1})
+
+	env, err := cfutil.NewEnvironmentFromMap(map[string]string{
+		"VCAP_APPLICATION": `{"name":"myapp"}`,
+		"VCAP_SERVICES": `{"p-rabbitmq":[{"name":"rabbitmq","credentials":{"uri":"amqp://localhost/",` +
+			`"protocols":{"management":{"uri":"` + server.URI() + `"}}}}]}`,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	admin, err := env.NewRabbitMQAdmin("rabbitmq")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, server.URL+"/api", admin.URL)
+	ctx := context.Background()
+
+	overview, err := admin.Overview(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, overview.ObjectTotals.Queues)
+	}
+
+	queues, err := admin.Queues(ctx, "/")
+	if assert.NoError(t, err) && assert.Len(t, queues, 1) {
+		assert.Equal(t, 7, queues[0].Messages)
+		assert.Equal(t, 1, queues[0].Consumers)
+	}
+
+	assert.NoError(t, admin.PurgeQueue(ctx, "", "orders"))
+	queue, err := admin.Queue(ctx, "", "orders")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, queue.MessagesReady)
+		assert.Equal(t, 2, queue.Messages)
+	}
+
+	_, err = admin.Queue(ctx, "", "missing")
+	var apiErr *cfutil.RabbitMQAdminError
+	if assert.True(t, errors.As(err, &apiErr)) {
+		assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	}
+
+	assert.NoError(t, admin.PutPolicy(ctx, cfutil.Policy{
+		Name:       "dlx",
+		Pattern:    "^orders",
+		ApplyTo:    "queues",
+		Definition: map[string]interface{}{"dead-letter-exchange": "orders.dlx"},
+	}))
+	policies, err := admin.Policies(ctx, "")
+	if assert.NoError(t, err) && assert.Len(t, policies, 1) {
+		assert.Equal(t, "^orders", policies[0].Pattern)
+	}
+	assert.NoError(t, admin.DeletePolicy(ctx, "", "dlx"))
+	assert.Len(t, server.Policies(), 0)
+
+	assert.NoError(t, admin.PutShovel(ctx, "", "move", cfutil.ShovelDefinition{
+		SrcURI:    "amqp://",
+		SrcQueue:  "orders",
+		DestURI:   "amqp://",
+		DestQueue: "orders.archive",
+	}))
+	shovels, err := admin.Shovels(ctx, "")
+	if assert.NoError(t, err) && assert.Len(t, shovels, 1) {
+		assert.Equal(t, "orders.archive", shovels[0].Value.DestQueue)
+	}
+	assert.NoError(t, admin.DeleteShovel(ctx, "", "move"))
+
+	admin.Password = "wrong"
+	_, err = admin.Overview(ctx)
+	assert.Error(t, err)
+}
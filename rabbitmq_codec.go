@@ -0,0 +1,218 @@
+package cfutil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"reflect"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+)
+
+// SchemaVersionHeader holds the schema version of messages whose type implements Versioned
+const SchemaVersionHeader = "x-schema-version"
+
+// ErrUndecodable is returned by handlers built with HandleJSON() and HandleCodec()
+// when a message cannot be decoded. Such messages are not retried but dead-lettered
+// or rejected right away.
+var ErrUndecodable = errors.New("Undecodable message")
+
+// Codec encodes and decodes message bodies
+type Codec interface {
+	// ContentType is set as the content type of published messages
+	ContentType() string
+	// ContentEncoding is set as the content encoding of published messages, if any
+	ContentEncoding() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Versioned can be implemented by message types to publish their schema version
+type Versioned interface {
+	SchemaVersion() string
+}
+
+var (
+	// JSONCodec encodes messages as `application/json`
+	JSONCodec Codec = jsonCodec{}
+	// GzipJSONCodec encodes messages as gzip compressed `application/json`
+	GzipJSONCodec Codec = gzipCodec{JSONCodec}
+)
+
+// codecs are the codecs a message can be decoded with, based on its content type and encoding
+var codecs = []Codec{JSONCodec, GzipJSONCodec}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string     { return "application/json" }
+func (jsonCodec) ContentEncoding() string { return "" }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// gzipCodec compresses the output of another codec
+type gzipCodec struct {
+	Codec
+}
+
+func (gzipCodec) ContentEncoding() string { return "gzip" }
+
+func (c gzipCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := c.Codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c gzipCodec) Unmarshal(data []byte, v interface{}) error {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	data, err = ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return c.Codec.Unmarshal(data, v)
+}
+
+// EncodeMessage() calls Environment.EncodeMessage() on the DefaultEnvironment()
+func EncodeMessage(codec Codec, v interface{}) (amqp.Publishing, error) {
+	name, err := GetApplicationName()
+	if err != nil {
+		name = ""
+	}
+	return encodeMessage(codec, v, name)
+}
+
+// EncodeMessage() encodes `v` with `codec` into a persistent message with a
+// new message ID, the current time, the application name as app ID and the
+// name of the type of `v` as type. The schema version is added to the headers
+// when `v` implements Versioned. Use it to pass typed messages to
+// Producer.PublishConfirmed() or Outbox.Enqueue().
+func (e *Environment) EncodeMessage(codec Codec, v interface{}) (amqp.Publishing, error) {
+	return encodeMessage(codec, v, e.Name)
+}
+
+func encodeMessage(codec Codec, v interface{}, appID string) (amqp.Publishing, error) {
+	body, err := codec.Marshal(v)
+	if err != nil {
+		return amqp.Publishing{}, fmt.Errorf("Error encoding message: %s", err.Error())
+	}
+	msg := amqp.Publishing{
+		ContentType:     codec.ContentType(),
+		ContentEncoding: codec.ContentEncoding(),
+		DeliveryMode:    amqp.Persistent,
+		MessageId:       uuid.New().String(),
+		Timestamp:       time.Now().UTC(),
+		Type:            typeName(v),
+		AppId:           appID,
+		Body:            body,
+	}
+	if versioned, ok := v.(Versioned); ok {
+		msg.Headers = amqp.Table{SchemaVersionHeader: versioned.SchemaVersion()}
+	}
+	return msg, nil
+}
+
+// PublishJSON() publishes `v` as JSON message through `p`
+func PublishJSON[T any](ctx context.Context, p *Producer, exchange, routingKey string, v T) error {
+	return PublishCodec(ctx, p, JSONCodec, exchange, routingKey, v)
+}
+
+// PublishCodec() publishes `v` through `p` encoded with `codec`, see
+// Environment.EncodeMessage() of the Environment `p` was created by
+func PublishCodec[T any](ctx context.Context, p *Producer, codec Codec, exchange, routingKey string, v T) error {
+	msg, err := p.env.EncodeMessage(codec, v)
+	if err != nil {
+		return err
+	}
+	return p.Publish(ctx, exchange, routingKey, msg)
+}
+
+// HandleJSON() returns a MessageHandler decoding JSON messages, plain or
+// gzip compressed, into a T for `handler`
+func HandleJSON[T any](handler func(ctx context.Context, msg T) error) MessageHandler {
+	return HandleCodec(JSONCodec, handler)
+}
+
+// HandleCodec() returns a MessageHandler decoding messages into a T for `handler`.
+// The codec is picked by the content type and encoding of each message from
+// `codec` and the built-in codecs, `codec` is also used for messages without
+// content type. Messages that cannot be decoded fail with ErrUndecodable.
+func HandleCodec[T any](codec Codec, handler func(ctx context.Context, msg T) error) MessageHandler {
+	return func(ctx context.Context, d amqp.Delivery) error {
+		var msg T
+		if err := decodeDelivery(codec, d, &msg); err != nil {
+			return err
+		}
+		return handler(ctx, msg)
+	}
+}
+
+// decodeDelivery decodes the body of `d` into `v`
+func decodeDelivery(fallback Codec, d amqp.Delivery, v interface{}) error {
+	codec := fallback
+	if d.ContentType != "" || d.ContentEncoding != "" {
+		codec = nil
+		for _, c := range append([]Codec{fallback}, codecs...) {
+			if mediaType(c.ContentType()) == mediaType(d.ContentType) && c.ContentEncoding() == d.ContentEncoding {
+				codec = c
+				break
+			}
+		}
+		if codec == nil {
+			return fmt.Errorf("%w: content type '%s' with encoding '%s' is not supported", ErrUndecodable, d.ContentType, d.ContentEncoding)
+		}
+	}
+	if err := codec.Unmarshal(d.Body, v); err != nil {
+		return fmt.Errorf("%w: %s", ErrUndecodable, err.Error())
+	}
+	return nil
+}
+
+// mediaType returns `contentType` without parameters like charset
+func mediaType(contentType string) string {
+	if contentType == "" {
+		return ""
+	}
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	return t
+}
+
+// typeName returns the name of the type of `v`, without pointers
+func typeName(v interface{}) string {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil {
+		return ""
+	}
+	return t.Name()
+}
@@ -0,0 +1,151 @@
+package cfutil_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/loafoe/cfutil"
+	"github.com/loafoe/cfutil/cfutiltest"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+type orderCreated struct {
+	ID    string `json:"id"`
+	Total int    `json:"total"`
+}
+
+func (orderCreated) SchemaVersion() string { return "2" }
+
+func TestCodecs(t *testing.T) {
+	order := orderCreated{ID: "42", Total: 100}
+	for _, codec := range []cfutil.Codec{cfutil.JSONCodec, cfutil.GzipJSONCodec} {
+		msg, err := cfutil.EncodeMessage(codec, &order)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, "application/json", msg.ContentType)
+		assert.Equal(t, codec.ContentEncoding(), msg.ContentEncoding)
+		assert.Equal(t, "orderCreated", msg.Type)
+		assert.Equal(t, "2", msg.Headers[cfutil.SchemaVersionHeader])
+		assert.NotEmpty(t, msg.MessageId)
+		assert.False(t, msg.Timestamp.IsZero())
+
+		var received orderCreated
+		handler := cfutil.HandleJSON(func(ctx context.Context, o orderCreated) error {
+			received = o
+			return nil
+		})
+		assert.NoError(t, handler(context.Background(), publishingToDelivery(msg)))
+		assert.Equal(t, order, received)
+	}
+
+	handler := cfutil.HandleJSON(func(ctx context.Context, o orderCreated) error { return nil })
+	assert.NoError(t, handler(context.Background(), amqp.Delivery{ContentType: "application/json; charset=utf-8", Body: []byte("{}")}))
+	err := handler(context.Background(), amqp.Delivery{Body: []byte("{")})
+	assert.True(t, errors.Is(err, cfutil.ErrUndecodable))
+	err = handler(context.Background(), amqp.Delivery{ContentType: "text/plain", Body: []byte("{}")})
+	assert.True(t, errors.Is(err, cfutil.ErrUndecodable))
+	assert.NoError(t, handler(context.Background(), amqp.Delivery{Body: []byte("{}")}))
+
+	// Custom codecs passed to HandleCodec() are matched too
+	var received string
+	textHandler := cfutil.HandleCodec(textCodec{}, func(ctx context.Context, s string) error {
+		received = s
+		return nil
+	})
+	assert.NoError(t, textHandler(context.Background(), amqp.Delivery{ContentType: "text/plain; charset=utf-8", Body: []byte("hi")}))
+	assert.Equal(t, "hi", received)
+	assert.NoError(t, textHandler(context.Background(), amqp.Delivery{ContentType: "application/json", Body: []byte(`"json"`)}))
+	assert.Equal(t, "json", received)
+}
+
+type textCodec struct{}
+
+func (textCodec) ContentType() string     { return "text/plain" }
+func (textCodec) ContentEncoding() string { return "" }
+
+func (textCodec) Marshal(v interface{}) ([]byte, error) {
+	return []byte(v.(string)), nil
+}
+
+func (textCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*string) = string(data)
+	return nil
+}
+
+func TestConsumerDeadLettersUndecodable(t *testing.T) {
+	broker := cfutiltest.NewBroker()
+	env, err := broker.Environment()
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn, _ := broker.Dial(broker.URI(), nil)
+	ch, _ := conn.Channel()
+	ch.ExchangeDeclare("orders.dlx", amqp.ExchangeFanout, true, false, false, false, nil)
+	ch.QueueDeclare("orders.dead", true, false, false, false, nil)
+	ch.QueueBind("orders.dead", "", "orders.dlx", false, nil)
+
+	received, appIDs := make(chan orderCreated, 1), make(chan string, 2)
+	handle := cfutil.HandleJSON(func(ctx context.Context, o orderCreated) error {
+		received <- o
+		return nil
+	})
+	consumer, err := env.NewConsumer(cfutil.ConsumerConfig{
+		Exchange:     "orders",
+		ExchangeType: amqp.ExchangeTopic,
+		QueueName:    "orders.created",
+		RoutingKey:   "order.created",
+		Dialer:       broker.Dial,
+		RetryPolicy:  cfutil.RetryPolicy{MaxAttempts: 3, DeadLetterExchange: "orders.dlx"},
+		MessageHandler: func(ctx context.Context, d amqp.Delivery) error {
+			appIDs <- d.AppId
+			return handle(ctx, d)
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, consumer.Start())
+	defer consumer.Stop()
+
+	producer, err := env.NewProducer(cfutil.ProducerConfig{Exchange: "orders", ExchangeType: amqp.ExchangeTopic, Dialer: broker.Dial})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer producer.Close()
+
+	ctx := context.Background()
+	assert.NoError(t, cfutil.PublishJSON(ctx, producer, "orders", "order.created", orderCreated{ID: "1"}))
+	select {
+	case o := <-received:
+		assert.Equal(t, "1", o.ID)
+		// The app ID comes from the Environment of the Producer
+		assert.Equal(t, "cfutiltest", <-appIDs)
+	case <-time.After(2 * time.Second):
+		t.Error("Timeout waiting for message")
+	}
+
+	assert.NoError(t, producer.Publish(ctx, "orders", "order.created", amqp.Publishing{ContentType: "application/json", Body: []byte("{")}))
+	deadline := time.Now().Add(2 * time.Second)
+	for len(broker.Messages("orders.dead")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	dead := broker.Messages("orders.dead")
+	if assert.Len(t, dead, 1) {
+		assert.Equal(t, int64(1), dead[0].Headers[cfutil.RetryCountHeader])
+	}
+}
+
+func publishingToDelivery(msg amqp.Publishing) amqp.Delivery {
+	return amqp.Delivery{
+		Headers:         msg.Headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		MessageId:       msg.MessageId,
+		Type:            msg.Type,
+		Body:            msg.Body,
+	}
+}
@@ -0,0 +1,165 @@
+package cfutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	// ErrPublishNacked is returned when the broker nacks a message
+	ErrPublishNacked = errors.New("Message nacked by broker")
+	// ErrPublishReturned is returned when a mandatory message could not be routed to any queue
+	ErrPublishReturned = errors.New("Message returned as unroutable")
+	// ErrPublishTimeout is returned when no confirm arrives before the context is done
+	ErrPublishTimeout = errors.New("Timeout waiting for publisher confirm")
+)
+
+// PublishError is returned by PublishConfirmed() when the broker did not accept
+// a message. Use errors.Is() with ErrPublishNacked, ErrPublishReturned or
+// ErrPublishTimeout to find out why.
+type PublishError struct {
+	Err    error
+	Return *amqp.Return // set for returned messages
+	Cause  error        // context error for timeouts
+}
+
+func (e *PublishError) Error() string {
+	switch {
+	case e.Return != nil:
+		return fmt.Sprintf("%s: %d %s", e.Err.Error(), e.Return.ReplyCode, e.Return.ReplyText)
+	case e.Cause != nil:
+		return fmt.Sprintf("%s: %s", e.Err.Error(), e.Cause.Error())
+	}
+	return e.Err.Error()
+}
+
+func (e *PublishError) Unwrap() error {
+	return e.Err
+}
+
+// confirmChannel is a channel in confirm mode used by PublishConfirmed()
+type confirmChannel struct {
+	conn     AMQPConnection // the connection the channel was opened on
+	channel  AMQPChannel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	closed   chan *amqp.Error
+}
+
+// PublishConfirmed() publishes `msg` as mandatory on a channel in confirm mode
+// and waits until the broker acks it or `ctx` is done. Like Publish() it adds
+// the correlation ID and trace context of `ctx` to the headers. Unlike Publish()
+// it never buffers, it returns ErrNotConnected while the Producer is reconnecting.
+// A channel exception, like NOT_FOUND for a missing exchange, is returned as
+// the *amqp.Error. Confirmed publishes are sent one at a time.
+func (p *Producer) PublishConfirmed(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	msg = injectTraceHeaders(ctx, msg)
+
+	p.confirmMu.Lock()
+	defer p.confirmMu.Unlock()
+
+	cc, err := p.confirmChannel()
+	if err != nil {
+		return err
+	}
+	if err := cc.channel.Publish(
+		exchange,   // publish to an exchange
+		routingKey, // routing to 0 or more queues
+		true,       // mandatory
+		false,      // immediate
+		msg,
+	); err != nil {
+		p.resetConfirmChannel()
+		if exception := cc.exception(); exception != nil {
+			return exception
+		}
+		return fmt.Errorf("Exchange Publish: %s", err)
+	}
+
+	select {
+	case confirm, ok := <-cc.confirms:
+		if !ok {
+			p.resetConfirmChannel()
+			if exception := cc.exception(); exception != nil {
+				return exception
+			}
+			return ErrNotConnected
+		}
+		// The broker sends basic.return before the ack of an unroutable message
+		select {
+		case ret := <-cc.returns:
+			return &PublishError{Err: ErrPublishReturned, Return: &ret}
+		default:
+		}
+		if !confirm.Ack {
+			return &PublishError{Err: ErrPublishNacked}
+		}
+		return nil
+	case <-ctx.Done():
+		// A late confirm would be mistaken for the next message, start over
+		p.resetConfirmChannel()
+		return &PublishError{Err: ErrPublishTimeout, Cause: ctx.Err()}
+	}
+}
+
+// confirmChannel returns the channel used for confirmed publishes,
+// opening it on the current connection when needed
+func (p *Producer) confirmChannel() (*confirmChannel, error) {
+	p.mu.Lock()
+	state, conn := p.state, p.conn
+	p.mu.Unlock()
+	if p.confirm != nil && p.confirm.conn != conn {
+		// The connection was replaced, the channel went with the old one
+		p.resetConfirmChannel()
+	}
+	if p.confirm != nil && state == StateConnected {
+		return p.confirm, nil
+	}
+	switch state {
+	case StateConnected:
+	case StateClosed:
+		return nil, ErrClosed
+	default:
+		return nil, ErrNotConnected
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("Channel: %s", err)
+	}
+	if err := channel.Confirm(false); err != nil {
+		channel.Close()
+		return nil, fmt.Errorf("Confirm: %s", err)
+	}
+	p.confirm = &confirmChannel{
+		conn:     conn,
+		channel:  channel,
+		confirms: channel.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		returns:  channel.NotifyReturn(make(chan amqp.Return, 1)),
+		closed:   channel.NotifyClose(make(chan *amqp.Error, 1)),
+	}
+	return p.confirm, nil
+}
+
+// exception returns the soft error that closed the channel, if any. Errors
+// closing the whole connection are left to the reconnect of the Producer.
+func (cc *confirmChannel) exception() *amqp.Error {
+	select {
+	case err := <-cc.closed:
+		if err != nil && err.Recover {
+			return err
+		}
+	default:
+	}
+	return nil
+}
+
+func (p *Producer) resetConfirmChannel() {
+	if p.confirm != nil {
+		p.confirm.channel.Close()
+		p.confirm = nil
+	}
+}
@@ -0,0 +1,189 @@
+package cfutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// DelayHeader holds the delay in milliseconds of messages published through
+// an exchange of the RabbitMQ delayed message plugin
+const DelayHeader = "x-delay"
+
+// delayedMessageExchange is the exchange type of the delayed message plugin
+const delayedMessageExchange = "x-delayed-message"
+
+// delayState tracks what PublishDelayed() declared on the current connection
+type delayState struct {
+	// plugin is nil until the delayed message plugin has been detected, the
+	// result is kept across reconnects as detecting it can cost a connection
+	plugin   *bool
+	conn     AMQPConnection
+	declared map[string]bool
+}
+
+// PublishDelayed() publishes `msg` to `exchange` so it is routed after `delay`.
+// It uses the delayed message plugin when RabbitMQ has it. Otherwise the message
+// waits in a queue with `delay` as message TTL, from which it is dead-lettered
+// to `exchange` with its routing key. These queues are declared automatically,
+// one per exchange and delay, so use a limited set of delays in that case.
+// Like PublishConfirmed() it returns ErrNotConnected while reconnecting.
+func (p *Producer) PublishDelayed(ctx context.Context, exchange, routingKey string, msg amqp.Publishing, delay time.Duration) error {
+	if delay <= 0 {
+		return p.Publish(ctx, exchange, routingKey, msg)
+	}
+	msg = injectTraceHeaders(ctx, msg)
+
+	p.delayMu.Lock()
+	defer p.delayMu.Unlock()
+
+	p.mu.Lock()
+	state, conn := p.state, p.conn
+	p.mu.Unlock()
+	switch state {
+	case StateConnected:
+	case StateClosed:
+		return ErrClosed
+	default:
+		return ErrNotConnected
+	}
+
+	target, err := p.declareDelay(ctx, conn, exchange, delay)
+	if err != nil {
+		return err
+	}
+	if target == delayedExchange(exchange) {
+		headers := make(amqp.Table, len(msg.Headers)+1)
+		for k, v := range msg.Headers {
+			headers[k] = v
+		}
+		headers[DelayHeader] = int64(delay / time.Millisecond)
+		msg.Headers = headers
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != conn {
+		return ErrNotConnected
+	}
+	if err := p.channel.Publish(
+		target,     // publish to an exchange
+		routingKey, // routing to 0 or more queues
+		false,      // mandatory
+		false,      // immediate
+		msg,
+	); err != nil {
+		return fmt.Errorf("Exchange Publish: %s", err)
+	}
+	return nil
+}
+
+// declareDelay declares what is needed to delay messages for `exchange` by
+// `delay` on `conn` and returns the exchange to publish them to
+func (p *Producer) declareDelay(ctx context.Context, conn AMQPConnection, exchange string, delay time.Duration) (string, error) {
+	if p.delays.conn != conn {
+		p.delays.conn, p.delays.declared = conn, map[string]bool{}
+	}
+	// The default exchange cannot be bound to
+	usePlugin := false
+	if exchange != "" {
+		available, err := p.delayPluginAvailable(delayedExchange(exchange))
+		if err != nil {
+			return "", err
+		}
+		usePlugin = available
+	}
+	name := delayQueue(exchange, delay)
+	if usePlugin {
+		name = delayedExchange(exchange)
+	}
+	if p.delays.declared[name] {
+		return name, nil
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		return "", fmt.Errorf("Channel: %s", err)
+	}
+	defer channel.Close()
+	if usePlugin {
+		if err := channel.ExchangeDeclare(name, delayedMessageExchange, true, false, false, false, delayedExchangeArgs()); err != nil {
+			return "", fmt.Errorf("Exchange Declare: %s", err)
+		}
+		if err := channel.ExchangeBind(exchange, "", name, false, nil); err != nil {
+			return "", fmt.Errorf("Exchange Bind: %s", err)
+		}
+		p.events.Declared(ctx, "exchange", name)
+		p.delays.declared[name] = true
+		return name, nil
+	}
+
+	if err := channel.ExchangeDeclare(name, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+		return "", fmt.Errorf("Exchange Declare: %s", err)
+	}
+	if _, err := channel.QueueDeclare(name, true, false, false, false, amqp.Table{
+		"x-message-ttl":          int64(delay / time.Millisecond),
+		"x-dead-letter-exchange": exchange,
+	}); err != nil {
+		return "", fmt.Errorf("Queue Declare: %s", err)
+	}
+	if err := channel.QueueBind(name, "", name, false, nil); err != nil {
+		return "", fmt.Errorf("Queue Bind: %s", err)
+	}
+	p.events.Declared(ctx, "exchange", name)
+	p.events.Declared(ctx, "queue", name)
+	p.delays.declared[name] = true
+	return name, nil
+}
+
+// delayPluginAvailable returns true if RabbitMQ has the delayed message plugin.
+// Without the plugin RabbitMQ closes the connection with COMMAND_INVALID when
+// an exchange of its type is declared, so it declares the plugin exchange `name`
+// on a connection of its own. Only COMMAND_INVALID means the plugin is missing.
+func (p *Producer) delayPluginAvailable(name string) (bool, error) {
+	if p.delays.plugin != nil {
+		return *p.delays.plugin, nil
+	}
+	conn, err := p.endpoints.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	channel, err := conn.Channel()
+	if err != nil {
+		return false, fmt.Errorf("Channel: %s", err)
+	}
+	err = channel.ExchangeDeclare(name, delayedMessageExchange, true, false, false, false, delayedExchangeArgs())
+	var amqpErr *amqp.Error
+	available := err == nil
+	switch {
+	case available:
+	case errors.As(err, &amqpErr) && amqpErr.Code == amqp.CommandInvalid:
+		p.log.Info(context.TODO(), "Delayed message plugin not available, using TTL queues: %v", err)
+	default:
+		return false, fmt.Errorf("Exchange Declare: %s", err)
+	}
+	p.delays.plugin = &available
+	return available, nil
+}
+
+func delayedExchangeArgs() amqp.Table {
+	return amqp.Table{"x-delayed-type": amqp.ExchangeFanout}
+}
+
+// delayedExchange returns the name of the plugin exchange delaying messages for `exchange`
+func delayedExchange(exchange string) string {
+	return exchange + ".delayed"
+}
+
+// delayQueue returns the name of the exchange and queue delaying messages for `exchange` by `delay`
+func delayQueue(exchange string, delay time.Duration) string {
+	if exchange == "" {
+		exchange = "default"
+	}
+	return exchange + ".delay." + strconv.FormatInt(int64(delay/time.Millisecond), 10)
+}
@@ -0,0 +1,81 @@
+package cfutil_test
+
+import (
+	"context"
+	"crypto/tls"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/loafoe/cfutil"
+	"github.com/loafoe/cfutil/cfutiltest"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishDelayed(t *testing.T) {
+	for _, plugin := range []bool{false, true} {
+		broker := cfutiltest.NewBroker()
+		broker.SetDelayedMessagePlugin(plugin)
+		env, err := broker.Environment()
+		if !assert.NoError(t, err) {
+			return
+		}
+		var dials, reconnects int32
+		producer, err := env.NewProducer(cfutil.ProducerConfig{
+			Exchange:     "reminders",
+			ExchangeType: amqp.ExchangeTopic,
+			Dialer: func(uri string, tlsConfig *tls.Config) (cfutil.AMQPConnection, error) {
+				atomic.AddInt32(&dials, 1)
+				return broker.Dial(uri, tlsConfig)
+			},
+			OnStateChange: func(state cfutil.ConnectionState, err error) {
+				if state == cfutil.StateReconnecting {
+					atomic.AddInt32(&reconnects, 1)
+				}
+			},
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		conn, _ := broker.Dial(broker.URI(), nil)
+		ch, _ := conn.Channel()
+		ch.QueueDeclare("reminders.due", true, false, false, false, nil)
+		ch.QueueBind("reminders.due", "reminder.#", "reminders", false, nil)
+
+		ctx := context.WithValue(context.Background(), cfutil.KeyCorrelationID, "abc")
+		start := time.Now()
+		assert.NoError(t, producer.PublishDelayed(ctx, "reminders", "reminder.email", amqp.Publishing{Body: []byte("1")}, 50*time.Millisecond))
+		assert.NoError(t, producer.PublishDelayed(ctx, "reminders", "reminder.sms", amqp.Publishing{Body: []byte("2")}, 50*time.Millisecond))
+		assert.NoError(t, producer.PublishDelayed(ctx, "", "reminders.due", amqp.Publishing{Body: []byte("3")}, 50*time.Millisecond))
+		assert.Empty(t, broker.Messages("reminders.due"))
+
+		for len(broker.Messages("reminders.due")) < 3 && time.Since(start) < 2*time.Second {
+			time.Sleep(5 * time.Millisecond)
+		}
+		assert.True(t, time.Since(start) >= 50*time.Millisecond)
+		messages := broker.Messages("reminders.due")
+		if assert.Len(t, messages, 3, "plugin: %v", plugin) {
+			keys := map[string]string{}
+			for _, m := range messages {
+				keys[string(m.Body)] = m.RoutingKey
+				assert.Equal(t, "abc", m.Headers[cfutil.CorrelationIDHeader])
+			}
+			assert.Equal(t, map[string]string{"1": "reminder.email", "2": "reminder.sms", "3": "reminders.due"}, keys)
+		}
+		_, hasDelayQueue := broker.Queue("reminders.delay.50")
+		assert.Equal(t, !plugin, hasDelayQueue)
+		// The plugin is detected once on a separate connection, the
+		// connection of the Producer is never dropped
+		assert.Equal(t, int32(2), atomic.LoadInt32(&dials))
+		assert.Equal(t, int32(0), atomic.LoadInt32(&reconnects))
+		assert.Equal(t, cfutil.StateConnected, producer.State())
+
+		// Without a delay the message is published right away
+		assert.NoError(t, producer.PublishDelayed(ctx, "reminders", "reminder.now", amqp.Publishing{}, 0))
+		assert.Len(t, broker.Messages("reminders.due"), 4)
+
+		producer.Close()
+		assert.Equal(t, cfutil.ErrClosed, producer.PublishDelayed(ctx, "reminders", "reminder.email", amqp.Publishing{}, time.Second))
+	}
+}
@@ -0,0 +1,222 @@
+package cfutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sync"
+
+	cfenv "github.com/cloudfoundry-community/go-cfenv"
+	"github.com/streadway/amqp"
+)
+
+// amqpCAKeys are the credential keys checked for a PEM encoded CA bundle
+var amqpCAKeys = []string{"ca_certificate", "cacrt", "ca"}
+
+// amqpEndpoints holds the URIs of the nodes of a RabbitMQ cluster and
+// dials them in turn, starting with the node that last worked
+type amqpEndpoints struct {
+	mu        sync.Mutex
+	uris      []string
+	next      int
+	tlsConfig *tls.Config
+	dialer    Dialer
+}
+
+// AMQPConnection is the part of *amqp.Connection used by Producer and Consumer
+type AMQPConnection interface {
+	Channel() (AMQPChannel, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// AMQPChannel is the part of *amqp.Channel used by Producer and Consumer
+type AMQPChannel interface {
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	ExchangeBind(destination, key, source string, noWait bool, args amqp.Table) error
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Cancel(consumer string, noWait bool) error
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(c chan amqp.Return) chan amqp.Return
+	NotifyClose(c chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// Dialer opens a connection to `uri`. `tlsConfig` is set for amqps URIs.
+// Replace the default in tests, e.g. with the in-memory broker in cfutiltest.
+type Dialer func(uri string, tlsConfig *tls.Config) (AMQPConnection, error)
+
+// amqpConnection adapts *amqp.Connection to AMQPConnection
+type amqpConnection struct {
+	*amqp.Connection
+}
+
+func (c amqpConnection) Channel() (AMQPChannel, error) {
+	return c.Connection.Channel()
+}
+
+// DialAMQP() is the default Dialer, connecting to a RabbitMQ server
+func DialAMQP(uri string, tlsConfig *tls.Config) (AMQPConnection, error) {
+	conn, err := amqp.DialTLS(uri, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return amqpConnection{conn}, nil
+}
+
+// amqpService returns the RabbitMQ service named `serviceName` or the first
+// service with an `amqp` or `amqps` URI when no name is given
+func (e *Environment) amqpService(serviceName string) (*cfenv.Service, error) {
+	if serviceName != "" {
+		return e.serviceByName(serviceName)
+	}
+	return e.firstMatchingService("amqps?")
+}
+
+// amqpEndpoints returns the endpoints of the RabbitMQ service named
+// `serviceName`. TLS URIs from `protocols.amqp+ssl` or `protocols.amqps`
+// are preferred over the ones in `protocols.amqp`, followed by the `uris`
+// and `uri` credentials. `tlsConfig` is used for amqps URIs, without it
+// one is built from the CA bundle in the binding or `CF_AMQP_CA_FILE`.
+func (e *Environment) amqpEndpoints(serviceName string, tlsConfig *tls.Config, dialer Dialer) (*amqpEndpoints, error) {
+	service, err := e.amqpService(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	uris := amqpURIs(service.Credentials)
+	if len(uris) == 0 {
+		return nil, fmt.Errorf("No AMQP URI found for service '%s'", service.Name)
+	}
+	if tlsConfig == nil {
+		tlsConfig, err = amqpTLSConfig(service.Credentials)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &amqpEndpoints{uris: uris, tlsConfig: tlsConfig, dialer: dialer}, nil
+}
+
+// amqpURIs collects the AMQP URIs in `credentials`, see amqpEndpoints()
+func amqpURIs(credentials map[string]interface{}) []string {
+	protocols, _ := credentials["protocols"].(map[string]interface{})
+	for _, name := range []string{"amqp+ssl", "amqps", "amqp"} {
+		protocol, ok := protocols[name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if uris := stringList(protocol["uris"]); len(uris) > 0 {
+			return uris
+		}
+		if uri, ok := protocol["uri"].(string); ok && uri != "" {
+			return []string{uri}
+		}
+	}
+	if uris := stringList(credentials["uris"]); len(uris) > 0 {
+		return uris
+	}
+	if uri, ok := credentials["uri"].(string); ok && uri != "" {
+		return []string{uri}
+	}
+	return nil
+}
+
+func stringList(value interface{}) []string {
+	var list []string
+	values, _ := value.([]interface{})
+	for _, v := range values {
+		if str, ok := v.(string); ok && str != "" {
+			list = append(list, str)
+		}
+	}
+	return list
+}
+
+// amqpTLSConfig returns a TLS config trusting the CA bundle found in
+// `credentials` or in the file named by `CF_AMQP_CA_FILE`. It returns
+// nil when neither is set, so the system roots are used.
+func amqpTLSConfig(credentials map[string]interface{}) (*tls.Config, error) {
+	var pem []byte
+	for _, key := range amqpCAKeys {
+		if str, ok := credentials[key].(string); ok && str != "" {
+			pem = []byte(str)
+			break
+		}
+	}
+	if pem == nil {
+		if file := os.Getenv("CF_AMQP_CA_FILE"); file != "" {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("Error reading CA file: %s", err.Error())
+			}
+			pem = data
+		}
+	}
+	if pem == nil {
+		return nil, nil
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("No certificates found in CA bundle")
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// dial connects to the first node that accepts the connection, starting
+// with the last one that worked. It returns the error of the last node tried.
+func (a *amqpEndpoints) dial() (AMQPConnection, error) {
+	if a == nil || len(a.uris) == 0 {
+		return nil, errors.New("Dial: no AMQP URI configured")
+	}
+	a.mu.Lock()
+	start := a.next
+	a.mu.Unlock()
+
+	var err error
+	for i := 0; i < len(a.uris); i++ {
+		index := (start + i) % len(a.uris)
+		var conn AMQPConnection
+		conn, err = a.dialURI(a.uris[index])
+		if err == nil {
+			a.mu.Lock()
+			a.next = index
+			a.mu.Unlock()
+			return conn, nil
+		}
+	}
+	return nil, fmt.Errorf("Dial: %s", err)
+}
+
+func (a *amqpEndpoints) dialURI(uri string) (AMQPConnection, error) {
+	dialer := a.dialer
+	if dialer == nil {
+		dialer = DialAMQP
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "amqps" {
+		return dialer(uri, nil)
+	}
+	var config *tls.Config
+	if a.tlsConfig != nil {
+		config = a.tlsConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		// Verify against the host name, not host:port
+		config.ServerName = u.Hostname()
+	}
+	return dialer(uri, config)
+}
@@ -0,0 +1,53 @@
+package cfutil
+
+import (
+	"context"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// EventHook receives lifecycle events of a Producer or Consumer, for
+// example to log them or update metrics. Embed NopEventHook to only
+// implement the events you are interested in. Hooks are called
+// synchronously and should return quickly.
+type EventHook interface {
+	// Connected is called when a connection and channel are opened
+	Connected(ctx context.Context)
+	// Disconnected is called when an open connection or channel is lost
+	Disconnected(ctx context.Context, err error)
+	// Reconnecting is called before waiting `delay` for reconnect `attempt`
+	Reconnecting(ctx context.Context, attempt int, delay time.Duration)
+	// Declared is called for each exchange or queue declared, `kind`
+	// being either `exchange` or `queue`
+	Declared(ctx context.Context, kind, name string)
+	// DeliveryFailed is called when the MessageHandler of a Consumer returns an error
+	DeliveryFailed(ctx context.Context, d amqp.Delivery, err error)
+}
+
+// NopEventHook is an EventHook that ignores all events
+type NopEventHook struct{}
+
+func (NopEventHook) Connected(ctx context.Context)                                      {}
+func (NopEventHook) Disconnected(ctx context.Context, err error)                        {}
+func (NopEventHook) Reconnecting(ctx context.Context, attempt int, delay time.Duration) {}
+func (NopEventHook) Declared(ctx context.Context, kind, name string)                    {}
+func (NopEventHook) DeliveryFailed(ctx context.Context, d amqp.Delivery, err error)     {}
+
+// declared reports the exchanges and queues of `t` to `hook`
+func (t *Topology) declared(ctx context.Context, hook EventHook) {
+	for _, e := range t.Exchanges {
+		hook.Declared(ctx, "exchange", e.Name)
+	}
+	for _, q := range t.Queues {
+		hook.Declared(ctx, "queue", q.Name)
+	}
+}
+
+// errorOrNil avoids turning a nil *amqp.Error into a non-nil error
+func errorOrNil(err *amqp.Error) error {
+	if err == nil {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,188 @@
+package cfutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// RetryCountHeader holds the number of failed attempts to handle a message
+	RetryCountHeader = "x-retry-count"
+	// LastErrorHeader holds the error of the last failed attempt of a dead-lettered message
+	LastErrorHeader = "x-last-error"
+)
+
+// MessageHandler processes a single delivery. The message is acked when it
+// returns nil, otherwise the RetryPolicy of the Consumer applies. Panics are
+// recovered and treated as errors.
+type MessageHandler func(ctx context.Context, d amqp.Delivery) error
+
+// RetryPolicy decides what happens to messages for which the MessageHandler
+// of a Consumer returns an error
+type RetryPolicy struct {
+	// MaxAttempts is the number of times a message is handled before it
+	// is dead-lettered. Zero or one means failed messages are not retried.
+	MaxAttempts int
+	// Delay is the time a failed message waits before it is handled again.
+	// When zero it is requeued at the back of the queue right away, otherwise
+	// it is parked on a retry exchange with a queue using Delay as TTL, from
+	// which it is dead-lettered back to the queue. For a server-named queue
+	// both are deleted when the connection closes.
+	Delay time.Duration
+	// DeadLetterExchange receives messages that exhausted their attempts,
+	// published with their original routing key. When empty these messages
+	// are rejected so a dead letter exchange configured on the queue applies.
+	DeadLetterExchange string
+}
+
+// retryExchange returns the name of the exchange holding delayed retries for `queue`.
+// Server-named queues start with `amq.`, which is reserved, so it is dropped.
+func retryExchange(queue string) string {
+	return strings.TrimPrefix(queue, "amq.") + ".retry"
+}
+
+// declareRetryTopology declares the exchange and TTL queue used to delay retries.
+// A server-named queue gets a new name on every reconnect, so its retry queue
+// is exclusive to the connection and its retry exchange is deleted along with
+// it. Retries still waiting when the connection is lost are dropped, just
+// like the messages left in the old server-named queue.
+func (c *Consumer) declareRetryTopology(queueName string) error {
+	if c.messageHandler == nil || c.retryPolicy.Delay <= 0 {
+		return nil
+	}
+	name := retryExchange(queueName)
+	temporary := c.queueName == ""
+	if err := c.channel.ExchangeDeclare(name, amqp.ExchangeFanout, !temporary, temporary, false, false, nil); err != nil {
+		return fmt.Errorf("Retry Exchange Declare: %s", err)
+	}
+	if _, err := c.channel.QueueDeclare(name, !temporary, false, temporary, false, amqp.Table{
+		"x-message-ttl":             int64(c.retryPolicy.Delay / time.Millisecond),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": queueName,
+	}); err != nil {
+		return fmt.Errorf("Retry Queue Declare: %s", err)
+	}
+	if err := c.channel.QueueBind(name, "", name, false, nil); err != nil {
+		return fmt.Errorf("Retry Queue Bind: %s", err)
+	}
+	return nil
+}
+
+// handleMessages is the ConsumerHandlerFunc used for a MessageHandler
+func (c *Consumer) handleMessages(deliveries <-chan amqp.Delivery) error {
+	for d := range deliveries {
+		c.handleMessage(d)
+	}
+	return nil
+}
+
+// handleMessage runs the MessageHandler for `d` and acks, retries
+// or dead-letters it depending on the outcome
+func (c *Consumer) handleMessage(d amqp.Delivery) {
+	ctx := ContextFromDelivery(context.Background(), d)
+	err := c.safeHandle(ctx, d)
+	if err == nil {
+		d.Ack(false)
+		return
+	}
+	c.events.DeliveryFailed(ctx, d, err)
+
+	attempts := retryCount(d.Headers) + 1
+	// Retrying does not help messages that cannot be decoded
+	if attempts < c.retryPolicy.MaxAttempts && !errors.Is(err, ErrUndecodable) {
+		c.log.Warning(ctx, "Handling message %s failed (attempt %d of %d): %v", d.MessageId, attempts, c.retryPolicy.MaxAttempts, err)
+		if retryErr := c.retry(d, attempts); retryErr != nil {
+			c.log.Error(ctx, "Scheduling retry failed, requeueing: %v", retryErr)
+			d.Nack(false, true)
+			return
+		}
+		d.Ack(false)
+		return
+	}
+
+	c.log.Error(ctx, "Handling message %s failed after %d attempts: %v", d.MessageId, attempts, err)
+	if c.retryPolicy.DeadLetterExchange == "" {
+		d.Nack(false, false)
+		return
+	}
+	msg := deliveryToPublishing(d)
+	msg.Headers[RetryCountHeader] = int64(attempts)
+	msg.Headers[LastErrorHeader] = err.Error()
+	if dlxErr := c.channel.Publish(c.retryPolicy.DeadLetterExchange, d.RoutingKey, false, false, msg); dlxErr != nil {
+		c.log.Error(ctx, "Dead-lettering failed, requeueing: %v", dlxErr)
+		d.Nack(false, true)
+		return
+	}
+	d.Ack(false)
+}
+
+// safeHandle runs the MessageHandler and turns a panic into an error
+func (c *Consumer) safeHandle(ctx context.Context, d amqp.Delivery) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.log.Error(ctx, "Message handler panic: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("Message handler panic: %v", r)
+		}
+	}()
+	return c.messageHandler(ctx, d)
+}
+
+// retry publishes a copy of `d` to be handled again, either directly
+// on the queue or through the retry exchange when a delay is configured
+func (c *Consumer) retry(d amqp.Delivery, attempts int) error {
+	msg := deliveryToPublishing(d)
+	msg.Headers[RetryCountHeader] = int64(attempts)
+	if c.retryPolicy.Delay > 0 {
+		return c.channel.Publish(retryExchange(c.queue), d.RoutingKey, false, false, msg)
+	}
+	return c.channel.Publish("", c.queue, false, false, msg)
+}
+
+// retryCount returns the value of the RetryCountHeader in `headers`
+func retryCount(headers amqp.Table) int {
+	switch v := headers[RetryCountHeader].(type) {
+	case int:
+		return v
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint8:
+		return int(v)
+	case float64:
+		return int(v)
+	}
+	return 0
+}
+
+// deliveryToPublishing copies `d` into a message that can be published again
+func deliveryToPublishing(d amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
@@ -0,0 +1,407 @@
+package cfutil
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+)
+
+const (
+	// DirectReplyTo is the pseudo-queue RabbitMQ provides for replies without declaring a queue
+	DirectReplyTo = "amq.rabbitmq.reply-to"
+	// RPCErrorHeader carries the error returned by the RPCHandler of an RPCServer
+	RPCErrorHeader = "x-rpc-error"
+	// DefaultRPCTimeout is the time a Call() waits for a reply when its context has no deadline
+	DefaultRPCTimeout = 30 * time.Second
+)
+
+// ErrRPCClientClosed is returned by Call() after Close()
+var ErrRPCClientClosed = errors.New("RPC client closed")
+
+// RPCError is returned by Call() when the RPCHandler of the server failed
+type RPCError struct {
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return "RPC failed: " + e.Message
+}
+
+type RPCClientConfig struct {
+	ServiceName string
+	// Exchange receives the requests, the default exchange when empty so the
+	// routing key passed to Call() is the name of the queue of the server
+	Exchange string
+	// TLSConfig is used for amqps URIs. When nil the CA bundle in the
+	// binding or the file in `CF_AMQP_CA_FILE` is trusted, if any.
+	TLSConfig *tls.Config
+	// Dialer opens connections, DialAMQP when nil
+	Dialer Dialer
+	// Timeout applies to calls with a context without deadline, DefaultRPCTimeout when zero
+	Timeout time.Duration
+	// Logger receives diagnostics, DefaultLogger when nil
+	Logger Logger
+}
+
+// RPCClient makes request/reply calls over RabbitMQ using direct reply-to.
+// Replies are matched to calls by correlation ID. It is safe for concurrent use.
+type RPCClient struct {
+	config    RPCClientConfig
+	endpoints *amqpEndpoints
+	log       Logger
+
+	mu      sync.Mutex
+	conn    AMQPConnection
+	channel AMQPChannel
+	closed  bool
+
+	// pendingMu is separate from mu so replies are never held up by a publish
+	pendingMu sync.Mutex
+	pending   map[string]chan rpcResult
+}
+
+type rpcResult struct {
+	reply amqp.Delivery
+	err   error
+}
+
+// NewRPCClient() calls Environment.NewRPCClient() on the DefaultEnvironment()
+func NewRPCClient(config RPCClientConfig) (*RPCClient, error) {
+	env, err := DefaultEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	return env.NewRPCClient(config)
+}
+
+// NewRPCClient() connects to the RabbitMQ service in `config`.
+// When the connection drops the next Call() reconnects.
+func (e *Environment) NewRPCClient(config RPCClientConfig) (*RPCClient, error) {
+	endpoints, err := e.amqpEndpoints(config.ServiceName, config.TLSConfig, config.Dialer)
+	if err != nil {
+		return nil, err
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultRPCTimeout
+	}
+	c := &RPCClient{
+		config:    config,
+		endpoints: endpoints,
+		log:       config.Logger,
+		pending:   map[string]chan rpcResult{},
+	}
+	if c.log == nil {
+		c.log = defaultLogger
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Call() publishes `msg` with `routingKey` and waits for the reply until `ctx`
+// is done. The correlation ID and trace context of `ctx` are added to the
+// headers and the message expires when the deadline passes, so servers skip
+// requests nobody waits for anymore. An *RPCError is returned when the server
+// reports a failure, a *PublishError when no queue receives the request.
+func (c *RPCClient) Call(ctx context.Context, routingKey string, msg amqp.Publishing) (amqp.Delivery, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.Timeout)
+		defer cancel()
+	}
+	deadline, _ := ctx.Deadline()
+	msg = injectTraceHeaders(ctx, msg)
+	msg.CorrelationId = uuid.New().String()
+	msg.ReplyTo = DirectReplyTo
+	if msg.Expiration == "" {
+		msg.Expiration = strconv.FormatInt(int64(time.Until(deadline)/time.Millisecond)+1, 10)
+	}
+	result := make(chan rpcResult, 1)
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return amqp.Delivery{}, ErrRPCClientClosed
+	}
+	if err := c.connect(); err != nil {
+		c.mu.Unlock()
+		return amqp.Delivery{}, err
+	}
+	c.addPending(msg.CorrelationId, result)
+	err := c.channel.Publish(
+		c.config.Exchange, // publish to an exchange
+		routingKey,        // routing to 0 or more queues
+		true,              // mandatory
+		false,             // immediate
+		msg,
+	)
+	if err != nil {
+		c.removePending(msg.CorrelationId)
+		c.disconnect(c.channel)
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return amqp.Delivery{}, fmt.Errorf("Exchange Publish: %s", err)
+	}
+
+	select {
+	case r := <-result:
+		return r.reply, r.err
+	case <-ctx.Done():
+		c.removePending(msg.CorrelationId)
+		return amqp.Delivery{}, fmt.Errorf("RPC call '%s': %w", routingKey, ctx.Err())
+	}
+}
+
+// Close() closes the connection, pending calls fail with ErrRPCClientClosed
+func (c *RPCClient) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn, c.channel = nil, nil
+	}
+	c.fail(ErrRPCClientClosed)
+}
+
+// connect opens a connection with a direct reply-to consumer, unless it is
+// still open. The caller holds mu.
+func (c *RPCClient) connect() error {
+	if c.channel != nil {
+		return nil
+	}
+	conn, err := c.endpoints.dial()
+	if err != nil {
+		return err
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("Channel: %s", err)
+	}
+	replies, err := channel.Consume(
+		DirectReplyTo, // queue
+		"",            // consumerTag
+		true,          // autoAck, required for direct reply-to
+		false,         // exclusive
+		false,         // noLocal
+		false,         // noWait
+		nil,           // arguments
+	)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("Queue Consume: %s", err)
+	}
+	returns := channel.NotifyReturn(make(chan amqp.Return, 1))
+	c.conn, c.channel = conn, channel
+
+	go func() {
+		for ret := range returns {
+			ret := ret
+			c.resolve(ret.CorrelationId, rpcResult{err: &PublishError{Err: ErrPublishReturned, Return: &ret}})
+		}
+	}()
+	go c.receive(channel, replies)
+	return nil
+}
+
+// receive hands replies to the waiting calls until the channel closes
+func (c *RPCClient) receive(channel AMQPChannel, replies <-chan amqp.Delivery) {
+	for d := range replies {
+		var err error
+		if message, ok := d.Headers[RPCErrorHeader].(string); ok {
+			err = &RPCError{Message: message}
+		}
+		c.resolve(d.CorrelationId, rpcResult{reply: d, err: err})
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.channel == channel {
+		c.log.Warning(context.TODO(), "RPC client connection lost")
+		c.disconnect(channel)
+	}
+}
+
+// disconnect closes the connection of `channel` when it is the current one,
+// so the next call reconnects. The caller holds mu.
+func (c *RPCClient) disconnect(channel AMQPChannel) {
+	if c.channel != channel || c.conn == nil {
+		return
+	}
+	c.conn.Close()
+	c.conn, c.channel = nil, nil
+	c.fail(ErrNotConnected)
+}
+
+func (c *RPCClient) addPending(id string, result chan rpcResult) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	c.pending[id] = result
+}
+
+// removePending removes the call with correlation ID `id` and returns its result channel
+func (c *RPCClient) removePending(id string) (chan rpcResult, bool) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	result, ok := c.pending[id]
+	delete(c.pending, id)
+	return result, ok
+}
+
+// resolve completes the call with correlation ID `id`, if it is still waiting
+func (c *RPCClient) resolve(id string, r rpcResult) {
+	if result, ok := c.removePending(id); ok {
+		result <- r
+	}
+}
+
+// fail completes all waiting calls with `err`
+func (c *RPCClient) fail(err error) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	for id, result := range c.pending {
+		result <- rpcResult{err: err}
+		delete(c.pending, id)
+	}
+}
+
+// RPCHandler handles a request and returns the reply. The correlation ID of
+// the reply is set by the RPCServer. When it returns an error the error is
+// sent back in the RPCErrorHeader instead.
+type RPCHandler func(ctx context.Context, request amqp.Delivery) (amqp.Publishing, error)
+
+type RPCServerConfig struct {
+	ServiceName  string
+	Exchange     string
+	ExchangeType string
+	QueueName    string
+	RoutingKey   string
+	// TLSConfig is used for amqps URIs. When nil the CA bundle in the
+	// binding or the file in `CF_AMQP_CA_FILE` is trusted, if any.
+	TLSConfig *tls.Config
+	// Dialer opens connections, DialAMQP when nil
+	Dialer Dialer
+	// Topology is declared on every (re)connect, see ConsumerConfig
+	Topology *Topology
+	Handler  RPCHandler
+	// Concurrency is the maximum number of requests handled at the same time, default 1
+	Concurrency int
+	// Backoff controls the delay between reconnect attempts, DefaultBackoff when empty
+	Backoff Backoff
+	// Logger receives diagnostics, DefaultLogger when nil
+	Logger Logger
+	// EventHook receives connection lifecycle events and failed deliveries
+	EventHook EventHook
+}
+
+// RPCServer answers requests of an RPCClient. It is a Consumer that
+// publishes the result of its RPCHandler to the reply-to of each request.
+type RPCServer struct {
+	consumer *Consumer
+	handler  RPCHandler
+	log      Logger
+}
+
+// NewRPCServer() calls Environment.NewRPCServer() on the DefaultEnvironment()
+func NewRPCServer(config RPCServerConfig) (*RPCServer, error) {
+	env, err := DefaultEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	return env.NewRPCServer(config)
+}
+
+// NewRPCServer() returns an RPCServer for the RabbitMQ service in `config`.
+// Call Run() or Start() to begin serving.
+func (e *Environment) NewRPCServer(config RPCServerConfig) (*RPCServer, error) {
+	if config.Handler == nil {
+		return nil, errors.New("No handler configured")
+	}
+	s := &RPCServer{
+		handler: config.Handler,
+		log:     config.Logger,
+	}
+	if s.log == nil {
+		s.log = defaultLogger
+	}
+	consumer, err := e.NewConsumer(ConsumerConfig{
+		ServiceName:    config.ServiceName,
+		Exchange:       config.Exchange,
+		ExchangeType:   config.ExchangeType,
+		QueueName:      config.QueueName,
+		RoutingKey:     config.RoutingKey,
+		TLSConfig:      config.TLSConfig,
+		Dialer:         config.Dialer,
+		MessageHandler: s.handle,
+		Topology:       config.Topology,
+		Workers:        config.Concurrency,
+		Backoff:        config.Backoff,
+		Logger:         config.Logger,
+		EventHook:      config.EventHook,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.consumer = consumer
+	return s, nil
+}
+
+// Run() serves requests until `ctx` is done, see Consumer.Run()
+func (s *RPCServer) Run(ctx context.Context) error {
+	return s.consumer.Run(ctx)
+}
+
+// Start() connects and serves requests in the background
+func (s *RPCServer) Start() error {
+	return s.consumer.Start()
+}
+
+// Stop() shuts down an RPCServer started with Start()
+func (s *RPCServer) Stop() error {
+	return s.consumer.Stop()
+}
+
+// handle runs the RPCHandler and publishes its reply
+func (s *RPCServer) handle(ctx context.Context, d amqp.Delivery) error {
+	reply, err := s.safeHandle(ctx, d)
+	if d.ReplyTo == "" {
+		s.log.Warning(ctx, "RPC request %s without reply-to", d.CorrelationId)
+		return err
+	}
+	if err != nil {
+		reply = amqp.Publishing{Headers: amqp.Table{RPCErrorHeader: err.Error()}}
+	}
+	reply = injectTraceHeaders(ctx, reply)
+	reply.CorrelationId = d.CorrelationId
+	if err := s.consumer.channel.Publish("", d.ReplyTo, false, false, reply); err != nil {
+		return fmt.Errorf("Reply Publish: %s", err)
+	}
+	return nil
+}
+
+// safeHandle runs the RPCHandler and turns a panic into an error,
+// so the client gets a reply instead of waiting for its timeout
+func (s *RPCServer) safeHandle(ctx context.Context, d amqp.Delivery) (reply amqp.Publishing, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.log.Error(ctx, "RPC handler panic: %v", r)
+			err = fmt.Errorf("RPC handler panic: %v", r)
+		}
+	}()
+	return s.handler(ctx, d)
+}
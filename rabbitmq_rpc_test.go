@@ -0,0 +1,121 @@
+package cfutil_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/loafoe/cfutil"
+	"github.com/loafoe/cfutil/cfutiltest"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRPC(t *testing.T) {
+	broker := cfutiltest.NewBroker()
+	env, err := broker.Environment()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	missing, err := env.NewRPCServer(cfutil.RPCServerConfig{ServiceName: "missing", QueueName: "rpc.upper"})
+	assert.Error(t, err)
+	assert.Nil(t, missing)
+
+	var running, maxRunning int32
+	server, err := env.NewRPCServer(cfutil.RPCServerConfig{
+		QueueName:   "rpc.upper",
+		Dialer:      broker.Dial,
+		Concurrency: 2,
+		Handler: func(ctx context.Context, request amqp.Delivery) (amqp.Publishing, error) {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			switch string(request.Body) {
+			case "fail":
+				return amqp.Publishing{}, errors.New("cannot do that")
+			case "panic":
+				panic("boom")
+			case "slow":
+				time.Sleep(50 * time.Millisecond)
+			}
+			return amqp.Publishing{Body: bytes.ToUpper(request.Body)}, nil
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, server.Start())
+	defer server.Stop()
+
+	client, err := env.NewRPCClient(cfutil.RPCClientConfig{Dialer: broker.Dial})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	ctx := context.WithValue(context.Background(), cfutil.KeyCorrelationID, "abc")
+	reply, err := client.Call(ctx, "rpc.upper", amqp.Publishing{Body: []byte("hello")})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "HELLO", string(reply.Body))
+		assert.Equal(t, "abc", reply.Headers[cfutil.CorrelationIDHeader])
+	}
+
+	_, err = client.Call(ctx, "rpc.upper", amqp.Publishing{Body: []byte("fail")})
+	var rpcErr *cfutil.RPCError
+	if assert.True(t, errors.As(err, &rpcErr)) {
+		assert.Equal(t, "cannot do that", rpcErr.Message)
+	}
+	_, err = client.Call(ctx, "rpc.upper", amqp.Publishing{Body: []byte("panic")})
+	assert.True(t, errors.As(err, &rpcErr))
+
+	_, err = client.Call(ctx, "rpc.unknown", amqp.Publishing{})
+	assert.True(t, errors.Is(err, cfutil.ErrPublishReturned))
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = client.Call(timeoutCtx, "rpc.upper", amqp.Publishing{Body: []byte("slow")})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	// Concurrent calls get their own replies, at most Concurrency are handled at once
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply, err := client.Call(ctx, "rpc.upper", amqp.Publishing{Body: []byte("slow")})
+			assert.NoError(t, err)
+			assert.Equal(t, "SLOW", string(reply.Body))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxRunning))
+
+	// The client reconnects on the next call after the connection drops
+	broker.Disconnect()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		q, _ := broker.Queue("rpc.upper")
+		if q.Consumers == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	reply, err = client.Call(ctx, "rpc.upper", amqp.Publishing{Body: []byte("again")})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "AGAIN", string(reply.Body))
+	}
+
+	client.Close()
+	_, err = client.Call(ctx, "rpc.upper", amqp.Publishing{})
+	assert.Equal(t, cfutil.ErrRPCClientClosed, err)
+}
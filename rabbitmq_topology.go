@@ -0,0 +1,180 @@
+package cfutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/streadway/amqp"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Topology describes the exchanges, queues and bindings an app expects on
+// RabbitMQ. Declaring it is idempotent as long as the definitions do not
+// change, RabbitMQ rejects redeclaring an existing entity with other settings.
+type Topology struct {
+	Exchanges []ExchangeSpec `yaml:"exchanges"`
+	Queues    []QueueSpec    `yaml:"queues"`
+	Bindings  []BindingSpec  `yaml:"bindings"`
+}
+
+// ExchangeSpec describes an exchange. Type defaults to `topic`.
+type ExchangeSpec struct {
+	Name       string                 `yaml:"name"`
+	Type       string                 `yaml:"type"`
+	Durable    bool                   `yaml:"durable"`
+	AutoDelete bool                   `yaml:"auto_delete"`
+	Internal   bool                   `yaml:"internal"`
+	Arguments  map[string]interface{} `yaml:"arguments"`
+}
+
+// QueueSpec describes a queue. The typed fields are translated into
+// the matching `x-` arguments and take precedence over Arguments.
+type QueueSpec struct {
+	Name       string `yaml:"name"`
+	Durable    bool   `yaml:"durable"`
+	AutoDelete bool   `yaml:"auto_delete"`
+	Exclusive  bool   `yaml:"exclusive"`
+	// Type is the queue type such as `classic` or `quorum`
+	Type                 string                 `yaml:"type"`
+	MessageTTL           time.Duration          `yaml:"message_ttl"`
+	MaxLength            int                    `yaml:"max_length"`
+	DeadLetterExchange   string                 `yaml:"dead_letter_exchange"`
+	DeadLetterRoutingKey string                 `yaml:"dead_letter_routing_key"`
+	Arguments            map[string]interface{} `yaml:"arguments"`
+}
+
+// BindingSpec binds a queue to an exchange. A queue can have several bindings.
+type BindingSpec struct {
+	Queue      string                 `yaml:"queue"`
+	Exchange   string                 `yaml:"exchange"`
+	RoutingKey string                 `yaml:"routing_key"`
+	Arguments  map[string]interface{} `yaml:"arguments"`
+}
+
+// LoadTopology() reads a Topology from the YAML file at `path`
+func LoadTopology(path string) (*Topology, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTopology(data)
+}
+
+// ParseTopology() parses a Topology in YAML format
+func ParseTopology(data []byte) (*Topology, error) {
+	var topology Topology
+	if err := yaml.UnmarshalStrict(data, &topology); err != nil {
+		return nil, fmt.Errorf("Invalid topology: %s", err)
+	}
+	return &topology, nil
+}
+
+// Declare() declares all exchanges, then all queues and finally all bindings on `channel`
+func (t *Topology) Declare(channel AMQPChannel) error {
+	for _, e := range t.Exchanges {
+		kind := e.Type
+		if kind == "" {
+			kind = amqp.ExchangeTopic
+		}
+		if err := channel.ExchangeDeclare(e.Name, kind, e.Durable, e.AutoDelete, e.Internal, false, amqpTable(e.Arguments)); err != nil {
+			return fmt.Errorf("Exchange Declare %q: %s", e.Name, err)
+		}
+	}
+	for _, q := range t.Queues {
+		if _, err := channel.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.arguments()); err != nil {
+			return fmt.Errorf("Queue Declare %q: %s", q.Name, err)
+		}
+	}
+	for _, b := range t.Bindings {
+		if err := channel.QueueBind(b.Queue, b.RoutingKey, b.Exchange, false, amqpTable(b.Arguments)); err != nil {
+			return fmt.Errorf("Queue Bind %q to %q: %s", b.Queue, b.Exchange, err)
+		}
+	}
+	return nil
+}
+
+// hasExchange returns true if `name` is declared by the Topology
+func (t *Topology) hasExchange(name string) bool {
+	if t == nil {
+		return false
+	}
+	for _, e := range t.Exchanges {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasQueue returns true if `name` is declared by the Topology
+func (t *Topology) hasQueue(name string) bool {
+	if t == nil {
+		return false
+	}
+	for _, q := range t.Queues {
+		if q.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (q QueueSpec) arguments() amqp.Table {
+	args := amqpTable(q.Arguments)
+	if args == nil {
+		args = amqp.Table{}
+	}
+	if q.Type != "" {
+		args["x-queue-type"] = q.Type
+	}
+	if q.MessageTTL > 0 {
+		args["x-message-ttl"] = int64(q.MessageTTL / time.Millisecond)
+	}
+	if q.MaxLength > 0 {
+		args["x-max-length"] = int64(q.MaxLength)
+	}
+	if q.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+	if q.DeadLetterRoutingKey != "" {
+		args["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// amqpTable converts `m` into a table with values of the types the
+// AMQP wire format supports, such as int64 instead of int
+func amqpTable(m map[string]interface{}) amqp.Table {
+	if len(m) == 0 {
+		return nil
+	}
+	table := make(amqp.Table, len(m))
+	for key, value := range m {
+		table[key] = amqpValue(value)
+	}
+	return table
+}
+
+func amqpValue(value interface{}) interface{} {
+	switch v := normalizeYAML(value).(type) {
+	case int:
+		return int64(v)
+	case uint:
+		return int64(v)
+	case time.Duration:
+		return int64(v / time.Millisecond)
+	case map[string]interface{}:
+		return amqpTable(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = amqpValue(v[i])
+		}
+		return v
+	default:
+		return v
+	}
+}
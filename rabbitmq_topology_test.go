@@ -0,0 +1,44 @@
+package cfutil
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadTopology(t *testing.T) {
+	topology, err := LoadTopology("testdata/topology.yml")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, topology.Exchanges, 2)
+	assert.Len(t, topology.Bindings, 3)
+	assert.True(t, topology.hasExchange("orders"))
+	assert.True(t, topology.hasQueue("orders.dead"))
+	assert.False(t, topology.hasQueue("orders"))
+
+	assert.Equal(t, amqp.Table{
+		"x-queue-type":           "quorum",
+		"x-message-ttl":          int64(3600000),
+		"x-max-length":           int64(10000),
+		"x-dead-letter-exchange": "orders.dlx",
+	}, topology.Queues[0].arguments())
+	assert.Nil(t, topology.Queues[1].arguments())
+
+	_, err = ParseTopology([]byte("queues:\n  - name: foo\n    ttl: 1s\n"))
+	assert.Error(t, err)
+
+	var nilTopology *Topology
+	assert.False(t, nilTopology.hasExchange("orders"))
+}
+
+func TestAMQPTable(t *testing.T) {
+	table := amqpTable(map[string]interface{}{
+		"x-max-priority": 10,
+		"nested":         map[interface{}]interface{}{"count": 1},
+	})
+	assert.Equal(t, int64(10), table["x-max-priority"])
+	assert.Equal(t, amqp.Table{"count": int64(1)}, table["nested"])
+	assert.NoError(t, table.Validate())
+}
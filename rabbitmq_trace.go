@@ -0,0 +1,80 @@
+package cfutil
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// CorrelationIDHeader carries the correlation ID of the publishing context.
+	// Publishing leaves the CorrelationId property alone so it can be used for
+	// RPC, consumers fall back to it for messages without this header.
+	CorrelationIDHeader = "x-correlation-id"
+	// TraceParentHeader carries the W3C trace context of the publishing context
+	TraceParentHeader = "traceparent"
+	// TraceStateHeader carries vendor specific W3C trace state
+	TraceStateHeader = "tracestate"
+)
+
+// Context keys holding the W3C trace context, like KeyCorrelationID
+const (
+	KeyTraceParent = "traceparent"
+	KeyTraceState  = "tracestate"
+)
+
+var traceParentRegex = regexp.MustCompile(`^[0-9a-f]{2}-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2}$`)
+
+// injectTraceHeaders returns `msg` with the correlation ID and trace context of
+// `ctx` added to its headers. Headers already set on `msg` are kept.
+func injectTraceHeaders(ctx context.Context, msg amqp.Publishing) amqp.Publishing {
+	values := map[string]string{
+		CorrelationIDHeader: correlationIDFromContext(ctx),
+		TraceParentHeader:   stringFromContext(ctx, KeyTraceParent),
+		TraceStateHeader:    stringFromContext(ctx, KeyTraceState),
+	}
+	headers := make(amqp.Table, len(msg.Headers)+len(values))
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	for k, v := range values {
+		if _, ok := headers[k]; !ok && v != "" {
+			headers[k] = v
+		}
+	}
+	if len(headers) > 0 {
+		msg.Headers = headers
+	}
+	return msg
+}
+
+// ContextFromDelivery() returns `ctx` carrying the correlation ID and W3C
+// trace context found in the headers of `d`. Without a correlation ID header
+// the CorrelationId property of `d` is used instead. A MessageHandler receives
+// such a context, HandlerFunc implementations can use this to get one.
+func ContextFromDelivery(ctx context.Context, d amqp.Delivery) context.Context {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if id, ok := d.Headers[CorrelationIDHeader].(string); ok && id != "" {
+		ctx = context.WithValue(ctx, KeyCorrelationID, id)
+	} else if d.CorrelationId != "" {
+		ctx = context.WithValue(ctx, KeyCorrelationID, d.CorrelationId)
+	}
+	if parent, ok := d.Headers[TraceParentHeader].(string); ok && traceParentRegex.MatchString(parent) {
+		ctx = context.WithValue(ctx, KeyTraceParent, parent)
+		if state, ok := d.Headers[TraceStateHeader].(string); ok && state != "" {
+			ctx = context.WithValue(ctx, KeyTraceState, state)
+		}
+	}
+	return ctx
+}
+
+func stringFromContext(ctx context.Context, key string) string {
+	if ctx == nil {
+		return ""
+	}
+	value, _ := ctx.Value(key).(string)
+	return value
+}
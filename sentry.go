@@ -6,14 +6,24 @@ import (
 	"strings"
 )
 
+// SentryDSN() calls Environment.SentryDSN() on the DefaultEnvironment()
 func SentryDSN(serviceName string) (string, error) {
-	appEnv, _ := Current()
+	env, err := DefaultEnvironment()
+	if err != nil {
+		return "", err
+	}
+	return env.SentryDSN(serviceName)
+}
+
+// SentryDSN() returns the Sentry DSN of the service named `serviceName`
+// or of the first service with a `sentry:` URI when no name is given
+func (e *Environment) SentryDSN(serviceName string) (string, error) {
 	var service *cfenv.Service
 	var err error
 	if serviceName != "" {
-		service, err = serviceByName(appEnv, serviceName)
+		service, err = e.serviceByName(serviceName)
 	} else {
-		service, err = firstMatchingServiceURN(appEnv, "sentry:")
+		service, err = e.firstMatchingServiceURN("sentry:")
 	}
 	if err != nil {
 		return "", err
@@ -9,21 +9,31 @@ import (
 )
 
 type SMTPService struct {
-	url.URL
-	Authentication     string
-	EnableStartTLSAuto string
-	Username           string
-	Password           string
+	url.URL            `mapstructure:"-"`
+	Authentication     string `mapstructure:"authentication"`
+	EnableStartTLSAuto string `mapstructure:"enable_starttls_auto"`
+	Username           string `mapstructure:"-"`
+	Password           string `mapstructure:"-"`
 }
 
+// FindSMTPService() calls Environment.FindSMTPService() on the DefaultEnvironment()
 func FindSMTPService(serviceName string) (*SMTPService, error) {
-	appEnv, _ := Current()
+	env, err := DefaultEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	return env.FindSMTPService(serviceName)
+}
+
+// FindSMTPService() returns the SMTP service named `serviceName`
+// or the first service with a `smtp:` URI when no name is given
+func (e *Environment) FindSMTPService(serviceName string) (*SMTPService, error) {
 	var service *cfenv.Service
 	var err error
 	if serviceName != "" {
-		service, err = serviceByName(appEnv, serviceName)
+		service, err = e.serviceByName(serviceName)
 	} else {
-		service, err = firstMatchingServiceURN(appEnv, "smtp:")
+		service, err = e.firstMatchingServiceURN("smtp:")
 	}
 	if err != nil {
 		return nil, err
@@ -36,6 +46,9 @@ func FindSMTPService(serviceName string) (*SMTPService, error) {
 		return nil, errors.New("SMTP credentials could not be read")
 	}
 	var s SMTPService
+	if err := DecodeCredentials(service, &s); err != nil {
+		return nil, err
+	}
 	str = strings.TrimPrefix(str, `smtp://`)
 	s.Scheme = `smtp`
 	splitted := strings.Split(str, `@`)
@@ -51,11 +64,5 @@ func FindSMTPService(serviceName string) (*SMTPService, error) {
 		s.User = url.UserPassword(userPass[0], "")
 		s.Username = userPass[0]
 	}
-	if str, ok := service.Credentials["authentication"].(string); ok {
-		s.Authentication = str
-	}
-	if str, ok := service.Credentials["enable_starttls_auto"].(string); ok {
-		s.EnableStartTLSAuto = str
-	}
 	return &s, nil
 }
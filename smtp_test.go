@@ -12,15 +12,15 @@ func TestFindSMTPService(t *testing.T) {
 	// Setup
 	os.Setenv("CF_LOCAL", "true")
 	os.Setenv("CF_LOCAL_SMTP", "smtp://foox:tuH5hM/yYtt@email-smtp.us-east-1.amazonaws.com:587")
-	_, err := Current()
+	env, err := NewEnvironment()
 	if !assert.NoError(t, err) {
 		return
 	}
 
-	service, err := FindSMTPService("")
+	service, err := env.FindSMTPService("")
 
 	if !assert.NoError(t, err) {
-		t.Errorf("VCAP_SERVICES: %s", os.Getenv("VCAP_SERVICES"))
+		t.Errorf("Services: %v", env.Services)
 		return
 	}
 	if !assert.NotNil(t, service) {
@@ -0,0 +1,4 @@
+CREATE TABLE orders (
+  id INTEGER PRIMARY KEY,
+  reference TEXT NOT NULL
+);
@@ -0,0 +1,4 @@
+CREATE TABLE orders_backup (id INTEGER PRIMARY KEY, reference TEXT NOT NULL);
+INSERT INTO orders_backup SELECT id, reference FROM orders;
+DROP TABLE orders;
+ALTER TABLE orders_backup RENAME TO orders;
@@ -13,6 +13,8 @@ import (
 // is the first running instance of the app within Cloudfoundry.
 // This is useful if you want to for example trigger database
 // migrations but only want to execute these on the first starting instance.
+// Note that index 0 may restart during rolling deploys, MigrateWithLock()
+// is the safer choice for migrations.
 func IsFirstInstance() bool {
 	appEnv, err := Current()
 
@@ -60,24 +62,24 @@ func Getenv(name string) string {
 	return os.Getenv(name)
 }
 
-func serviceByName(env *cfenv.App, serviceName string) (*cfenv.Service, error) {
-	service, err := env.Services.WithName(serviceName)
+func (e *Environment) serviceByName(serviceName string) (*cfenv.Service, error) {
+	services := e.services()
+	service, err := services.WithName(serviceName)
 	if err != nil {
 		return nil, err
 	}
+	if err := e.credentialError(*service); err != nil {
+		return nil, err
+	}
 	return service, nil
 }
 
-func serviceByTag(env *cfenv.App, serviceTag string) (*cfenv.Service, error) {
-	service, err := env.Services.WithTag(serviceTag)
-	if err != nil {
-		return nil, err
-	}
-	return &service[0], nil
+func (e *Environment) serviceByTag(serviceTag string) (*cfenv.Service, error) {
+	return e.MustFindOne(Query{Tag: serviceTag})
 }
 
-func serviceURIByName(env *cfenv.App, serviceName string) (string, error) {
-	service, err := serviceByName(env, serviceName)
+func (e *Environment) serviceURIByName(serviceName string) (string, error) {
+	service, err := e.serviceByName(serviceName)
 	if err != nil {
 		return "", err
 	}
@@ -88,46 +90,48 @@ func serviceURIByName(env *cfenv.App, serviceName string) (string, error) {
 	return str, nil
 }
 
-func firstMatchingService(env *cfenv.App, schema string) (*cfenv.Service, error) {
+func (e *Environment) firstMatchingService(schema string) (*cfenv.Service, error) {
 	regex, err := regexp.Compile("^" + schema + "://")
 	if err != nil {
 		return nil, err
 	}
-	for _, services := range env.Services {
-		for _, service := range services {
-			str, ok := service.Credentials["uri"].(string)
-			if !ok {
-				continue
-			}
-			if regex.MatchString(str) {
-				return &service, nil
-			}
+	for _, service := range e.orderedServices() {
+		str, ok := service.Credentials["uri"].(string)
+		if !ok {
+			continue
+		}
+		if regex.MatchString(str) {
+			return &service, nil
 		}
 	}
+	if err := e.credentialError(); err != nil {
+		return nil, err
+	}
 	return nil, fmt.Errorf("No matching service found for '%s'", schema)
 }
 
-func firstMatchingServiceURN(env *cfenv.App, urn string) (*cfenv.Service, error) {
+func (e *Environment) firstMatchingServiceURN(urn string) (*cfenv.Service, error) {
 	regex, err := regexp.Compile("^" + urn)
 	if err != nil {
 		return nil, err
 	}
-	for _, services := range env.Services {
-		for _, service := range services {
-			str, ok := service.Credentials["uri"].(string)
-			if !ok {
-				continue
-			}
-			if regex.MatchString(str) {
-				return &service, nil
-			}
+	for _, service := range e.orderedServices() {
+		str, ok := service.Credentials["uri"].(string)
+		if !ok {
+			continue
+		}
+		if regex.MatchString(str) {
+			return &service, nil
 		}
 	}
+	if err := e.credentialError(); err != nil {
+		return nil, err
+	}
 	return nil, fmt.Errorf("No matching service found for urn '%s'", urn)
 }
 
-func firstMatchingServiceURI(env *cfenv.App, schema string) (string, error) {
-	service, err := firstMatchingService(env, schema)
+func (e *Environment) firstMatchingServiceURI(schema string) (string, error) {
+	service, err := e.firstMatchingService(schema)
 	if err != nil {
 		return "", err
 	}
@@ -138,13 +142,14 @@ func firstMatchingServiceURI(env *cfenv.App, schema string) (string, error) {
 	return str, nil
 }
 
-func firstMatchingServiceByCredential(env *cfenv.App, credential string) (*cfenv.Service, error) {
-	for _, services := range env.Services {
-		for _, service := range services {
-			if service.Credentials[credential] != nil {
-				return &service, nil
-			}
+func (e *Environment) firstMatchingServiceByCredential(credential string) (*cfenv.Service, error) {
+	for _, service := range e.orderedServices() {
+		if service.Credentials[credential] != nil {
+			return &service, nil
 		}
 	}
+	if err := e.credentialError(); err != nil {
+		return nil, err
+	}
 	return nil, fmt.Errorf("No matching service found that contains credential '%s'", credential)
 }
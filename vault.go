@@ -11,15 +11,17 @@ import (
 
 var v1Regex = regexp.MustCompile(`/v1/`)
 
+// VaultClient is a Vault API client for a bound Vault service. It embeds a
+// *vault.Client, as copying a vault.Client would copy its lock.
 type VaultClient struct {
-	vault.Client
-	Endpoint           string
-	RoleID             string
-	SecretID           string
-	ServiceSecretPath  string
-	ServiceTransitPath string
-	SpaceSecretPath    string
-	OrgSecretPath      string
+	*vault.Client
+	Endpoint           string `mapstructure:"endpoint"`
+	RoleID             string `mapstructure:"role_id"`
+	SecretID           string `mapstructure:"secret_id"`
+	ServiceSecretPath  string `mapstructure:"service_secret_path"`
+	ServiceTransitPath string `mapstructure:"service_transit_path"`
+	SpaceSecretPath    string `mapstructure:"space_secret_path"`
+	OrgSecretPath      string `mapstructure:"org_secret_path"`
 	Secret             *vault.Secret
 }
 
@@ -62,14 +64,24 @@ func (v *VaultClient) ReadString(prefix, path string) (string, error) {
 	return str, nil
 }
 
+// NewVaultClient() calls Environment.NewVaultClient() on the DefaultEnvironment()
 func NewVaultClient(serviceName string) (*VaultClient, error) {
-	appEnv, _ := Current()
+	env, err := DefaultEnvironment()
+	if err != nil {
+		return nil, err
+	}
+	return env.NewVaultClient(serviceName)
+}
+
+// NewVaultClient() returns a logged in client for the Vault service named
+// `serviceName` or the first service tagged `Vault` when no name is given
+func (e *Environment) NewVaultClient(serviceName string) (*VaultClient, error) {
 	var service *cfenv.Service
 	var err error
 	if serviceName != "" {
-		service, err = serviceByName(appEnv, serviceName)
+		service, err = e.serviceByName(serviceName)
 	} else {
-		service, err = serviceByTag(appEnv, "Vault")
+		service, err = e.serviceByTag("Vault")
 	}
 	if err != nil {
 		return nil, err
@@ -78,28 +90,13 @@ func NewVaultClient(serviceName string) (*VaultClient, error) {
 		return nil, errors.New("Vault service not found")
 	}
 	var vaultClient VaultClient
-
-	if str, ok := service.Credentials["role_id"].(string); ok {
-		vaultClient.RoleID = str
-	}
-	if str, ok := service.Credentials["secret_id"].(string); ok {
-		vaultClient.SecretID = str
-	}
-	if str, ok := service.Credentials["org_secret_path"].(string); ok {
-		vaultClient.OrgSecretPath = v1Regex.ReplaceAllString(str, "")
-	}
-	if str, ok := service.Credentials["service_secret_path"].(string); ok {
-		vaultClient.ServiceSecretPath = v1Regex.ReplaceAllString(str, "")
-	}
-	if str, ok := service.Credentials["endpoint"].(string); ok {
-		vaultClient.Endpoint = str
-	}
-	if str, ok := service.Credentials["space_secret_path"].(string); ok {
-		vaultClient.SpaceSecretPath = v1Regex.ReplaceAllString(str, "")
-	}
-	if str, ok := service.Credentials["service_transit_path"].(string); ok {
-		vaultClient.ServiceTransitPath = v1Regex.ReplaceAllString(str, "")
+	if err := DecodeCredentials(service, &vaultClient); err != nil {
+		return nil, err
 	}
+	vaultClient.OrgSecretPath = v1Regex.ReplaceAllString(vaultClient.OrgSecretPath, "")
+	vaultClient.ServiceSecretPath = v1Regex.ReplaceAllString(vaultClient.ServiceSecretPath, "")
+	vaultClient.SpaceSecretPath = v1Regex.ReplaceAllString(vaultClient.SpaceSecretPath, "")
+	vaultClient.ServiceTransitPath = v1Regex.ReplaceAllString(vaultClient.ServiceTransitPath, "")
 
 	client, err := vault.NewClient(&vault.Config{
 		Address: vaultClient.Endpoint,
@@ -107,7 +104,7 @@ func NewVaultClient(serviceName string) (*VaultClient, error) {
 	if err != nil {
 		return nil, err
 	}
-	vaultClient.Client = *client
+	vaultClient.Client = client
 	err = vaultClient.Login()
 	if err != nil {
 		return nil, err